@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/pkg/errors"
+)
+
+type addressUse struct {
+	Address    string
+	LastUse    time.Time
+	LastAmount uint64
+}
+
+// addressUsageClaim is the rate limit slot of a recipient address,
+// claimed before paying it, like ipUsageClaim.
+type addressUsageClaim struct {
+	address   string
+	claimTime time.Time
+}
+
+// claimAddressUsage claims the rate limit slot of the given address for
+// a payout of the given amount. It fails with http.StatusForbidden if
+// the address was already paid within the given interval, no matter
+// from which IP it was requested.
+func claimAddressUsage(address string, amountSompi uint64, addressRequestInterval time.Duration) (
+	*addressUsageClaim, error) {
+
+	db, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Truncate(time.Microsecond)
+	timeBeforeAddressRequestInterval := now.Add(-addressRequestInterval)
+	result, err := db.Model(&addressUse{Address: address, LastUse: now, LastAmount: amountSompi}).
+		OnConflict("(address) DO UPDATE").
+		Set("last_use = EXCLUDED.last_use").
+		Set("last_amount = EXCLUDED.last_amount").
+		Where("address_use.last_use < ?", timeBeforeAddressRequestInterval).
+		Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	if result.RowsAffected() == 0 {
+		// The usage may have been released since, in which case the
+		// request may be retried right away.
+		lastUse := &addressUse{Address: address, LastUse: now.Add(-addressRequestInterval)}
+		err := db.Model(lastUse).Where("address = ?", address).Select()
+		if err != nil && !errors.Is(err, pg.ErrNoRows) {
+			return nil, err
+		}
+		return nil, httpserverutils.NewRateLimitHandlerError(
+			errors.Errorf("address %s was paid within the last %s", address, addressRequestInterval),
+			fmt.Sprintf("An address is allowed to receive one payout from the faucet every %s",
+				formatWindow(addressRequestInterval)),
+			lastUse.LastUse.Add(addressRequestInterval).Sub(now))
+	}
+	return &addressUsageClaim{address: address, claimTime: now}, nil
+}
+
+// commit records the amount that was actually paid for the claim.
+func (c *addressUsageClaim) commit(amountSompi uint64) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&addressUse{}).
+		Set("last_amount = ?", amountSompi).
+		Where("address = ?", c.address).
+		Where("last_use = ?", c.claimTime).
+		Update()
+	return err
+}
+
+// rollback frees the claimed slot, even after it was committed, which
+// happens when the payout fails after it was submitted.
+func (c *addressUsageClaim) rollback() error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&addressUse{}).
+		Where("address = ?", c.address).
+		Where("last_use = ?", c.claimTime).
+		Delete()
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// balanceCheckInterval is the interval between checks of the
+// faucet's spendable balance.
+const balanceCheckInterval = time.Minute
+
+// balanceMonitor alerts when the spendable balance falls below any of
+// its thresholds. An alert isn't sent again for the same threshold until
+// the balance rises above it by the hysteresis ratio, so a balance that
+// hovers around a threshold doesn't flood the notifiers.
+type balanceMonitor struct {
+	thresholds []uint64
+	hysteresis float64
+	notifiers  []Notifier
+
+	// triggeredThresholds are the thresholds the balance fell below
+	// and didn't recover from yet.
+	triggeredThresholds map[uint64]bool
+}
+
+func newBalanceMonitor(thresholds []uint64, hysteresis float64, notifiers []Notifier) *balanceMonitor {
+	sortedThresholds := make([]uint64, len(thresholds))
+	copy(sortedThresholds, thresholds)
+	sort.Slice(sortedThresholds, func(i, j int) bool { return sortedThresholds[i] < sortedThresholds[j] })
+	return &balanceMonitor{
+		thresholds:          sortedThresholds,
+		hysteresis:          hysteresis,
+		notifiers:           notifiers,
+		triggeredThresholds: make(map[uint64]bool),
+	}
+}
+
+// check compares the given spendable balance with the thresholds. When
+// the balance falls below several thresholds at once, only the lowest
+// of them is alerted, and when it recovers above several thresholds at
+// once only the highest of them is.
+func (m *balanceMonitor) check(balance uint64) {
+	var lowAlertThreshold, recoveredAlertThreshold uint64
+	hasLowAlert, hasRecoveredAlert := false, false
+	for i := len(m.thresholds) - 1; i >= 0; i-- {
+		threshold := m.thresholds[i]
+		if !m.triggeredThresholds[threshold] && balance < threshold {
+			m.triggeredThresholds[threshold] = true
+			lowAlertThreshold, hasLowAlert = threshold, true
+		}
+	}
+	for _, threshold := range m.thresholds {
+		recoveryBalance := uint64(float64(threshold) * (1 + m.hysteresis))
+		if m.triggeredThresholds[threshold] && balance >= recoveryBalance {
+			delete(m.triggeredThresholds, threshold)
+			recoveredAlertThreshold, hasRecoveredAlert = threshold, true
+		}
+	}
+
+	if hasLowAlert {
+		m.notify(&balanceAlert{
+			Kind:           balanceAlertKindLow,
+			Address:        faucetAddress.EncodeAddress(),
+			BalanceSompi:   balance,
+			ThresholdSompi: lowAlertThreshold,
+		})
+	}
+	if hasRecoveredAlert {
+		m.notify(&balanceAlert{
+			Kind:           balanceAlertKindRecovered,
+			Address:        faucetAddress.EncodeAddress(),
+			BalanceSompi:   balance,
+			ThresholdSompi: recoveredAlertThreshold,
+		})
+	}
+}
+
+func (m *balanceMonitor) notify(alert *balanceAlert) {
+	for _, notifier := range m.notifiers {
+		err := notifier.Notify(alert)
+		if err != nil {
+			log.Errorf("Error sending a balance alert: %s", err)
+		}
+	}
+}
+
+// balanceMonitorLoop periodically checks the spendable balance
+// once the wallet is synced.
+func balanceMonitorLoop(monitor *balanceMonitor) {
+	for range time.Tick(balanceCheckInterval) {
+		balance := faucetWallet.balance()
+		if !balance.isSynced {
+			continue
+		}
+		monitor.check(balance.spendable)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kaspanet/kaspad/util"
+)
+
+// recordingNotifier records the alerts it's notified of.
+type recordingNotifier struct {
+	alerts []balanceAlert
+}
+
+func (n *recordingNotifier) Notify(alert *balanceAlert) error {
+	n.alerts = append(n.alerts, *alert)
+	return nil
+}
+
+func TestBalanceMonitorCheck(t *testing.T) {
+	var err error
+	faucetAddress, err = util.NewAddressPublicKey(make([]byte, util.PublicKeySize), util.Bech32PrefixKaspaTest)
+	if err != nil {
+		t.Fatalf("Error creating an address: %s", err)
+	}
+
+	type alert struct {
+		kind      balanceAlertKind
+		threshold uint64
+	}
+	low := func(threshold uint64) alert { return alert{kind: balanceAlertKindLow, threshold: threshold} }
+	recovered := func(threshold uint64) alert { return alert{kind: balanceAlertKindRecovered, threshold: threshold} }
+
+	// Every step checks a balance against thresholds of 100 and 1000
+	// with a hysteresis of 10%, and expects the alerts of the check
+	steps := []struct {
+		balance        uint64
+		expectedAlerts []alert
+	}{
+		{balance: 2000},
+		{balance: 999, expectedAlerts: []alert{low(1000)}},
+		{balance: 500},
+		{balance: 1050},
+		{balance: 1099},
+		{balance: 1100, expectedAlerts: []alert{recovered(1000)}},
+		{balance: 999, expectedAlerts: []alert{low(1000)}},
+		{balance: 50, expectedAlerts: []alert{low(100)}},
+		{balance: 10},
+		{balance: 1200, expectedAlerts: []alert{recovered(1000)}},
+		{balance: 50, expectedAlerts: []alert{low(100)}},
+		{balance: 105},
+		{balance: 110, expectedAlerts: []alert{recovered(100)}},
+		{balance: 5000, expectedAlerts: []alert{recovered(1000)}},
+		{balance: 20, expectedAlerts: []alert{low(100)}},
+	}
+
+	notifier := &recordingNotifier{}
+	monitor := newBalanceMonitor([]uint64{1000, 100}, 0.1, []Notifier{notifier})
+	for i, step := range steps {
+		notifier.alerts = nil
+		monitor.check(step.balance)
+
+		var alerts []alert
+		for _, balanceAlert := range notifier.alerts {
+			if balanceAlert.BalanceSompi != step.balance {
+				t.Errorf("step %d: expected an alert of balance %d, got %d", i, step.balance, balanceAlert.BalanceSompi)
+			}
+			alerts = append(alerts, alert{kind: balanceAlert.Kind, threshold: balanceAlert.ThresholdSompi})
+		}
+		if !reflect.DeepEqual(alerts, step.expectedAlerts) {
+			t.Errorf("step %d: balance %d: expected alerts %v, got %v", i, step.balance, step.expectedAlerts, alerts)
+		}
+	}
+}
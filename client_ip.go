@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies are the networks of the reverse proxies whose forwarding
+// headers are trusted to tell the IP of the client.
+var trustedProxies []*net.IPNet
+
+// clientIPHeader is the forwarding header that the trusted proxies set.
+// Any other forwarding header may come from the client, and is ignored.
+var clientIPHeader string
+
+// parseTrustedProxies parses the given CIDRs. Each of them may also be a
+// comma-separated list, or a single IP.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidrList := range cidrs {
+		for _, cidr := range strings.Split(cidrList, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			if !strings.Contains(cidr, "/") {
+				ip := net.ParseIP(cidr)
+				if ip == nil {
+					return nil, errors.Errorf("malformed trusted proxy %s", cidr)
+				}
+				if ipv4 := ip.To4(); ipv4 != nil {
+					ip = ipv4
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+				continue
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "malformed trusted proxy %s", cidr)
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client that made the request. If the
+// request comes from a trusted proxy, the chain of IPs in clientIPHeader is
+// walked from right to left, and the first IP that isn't of a trusted proxy is
+// the client's. Anything to its left may be spoofed by the client, and
+// the headers of untrusted peers are ignored altogether.
+func clientIP(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("malformed IP %s", host)
+	}
+	if !isTrustedProxy(ip) {
+		return ip, nil
+	}
+
+	forwardedIPs := forwardedChain(r.Header, clientIPHeader)
+	for i := len(forwardedIPs) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(forwardedIPs[i])
+		if forwardedIP == nil {
+			// The hop can't be told, such as with Forwarded's "unknown",
+			// so the last trusted proxy is treated as the client.
+			return ip, nil
+		}
+		ip = forwardedIP
+		if !isTrustedProxy(ip) {
+			return ip, nil
+		}
+	}
+	return ip, nil
+}
+
+// forwardedChain returns the chain of forwarded IPs in the given header,
+// which is one of X-Forwarded-For, X-Real-IP and Forwarded, from the
+// original client to the last proxy.
+func forwardedChain(header http.Header, name string) []string {
+	var chain []string
+	switch name {
+	case "X-Forwarded-For":
+		for _, value := range header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				chain = append(chain, stripPort(strings.TrimSpace(hop)))
+			}
+		}
+	case "X-Real-IP":
+		if realIP := strings.TrimSpace(header.Get("X-Real-IP")); realIP != "" {
+			chain = append(chain, stripPort(realIP))
+		}
+	case "Forwarded":
+		for _, value := range header.Values("Forwarded") {
+			for _, element := range strings.Split(value, ",") {
+				chain = append(chain, forwardedElementFor(element))
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedElementFor returns the IP in the "for" parameter of a single
+// element of an RFC 7239 Forwarded header, without its port. It returns
+// an empty string if the parameter is missing, or if it isn't an IP.
+func forwardedElementFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, ok := cutString(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(name, "for") {
+			continue
+		}
+		return stripPort(strings.Trim(value, `"`))
+	}
+	return ""
+}
+
+// stripPort returns the IP of a hop without its port, such as 1.2.3.4 of
+// 1.2.3.4:555, or 2001:db8::1 of [2001:db8::1]:4711. It returns an empty
+// string for a bracketed IPv6 address that isn't closed.
+func stripPort(hop string) string {
+	if strings.HasPrefix(hop, "[") {
+		end := strings.Index(hop, "]")
+		if end < 0 {
+			return ""
+		}
+		return hop[1:end]
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return host
+	}
+	return hop
+}
+
+func cutString(s string, separator string) (before string, after string, found bool) {
+	if i := strings.Index(s, separator); i >= 0 {
+		return s[:i], s[i+len(separator):], true
+	}
+	return s, "", false
+}
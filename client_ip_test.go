@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8,::1"})
+	if err != nil {
+		t.Fatalf("Error parsing the trusted proxies: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		headers    map[string]string
+		expectedIP string
+	}{
+		{
+			name:       "untrusted peer's headers are ignored",
+			remoteAddr: "1.2.3.4:1000",
+			header:     "X-Forwarded-For",
+			headers:    map[string]string{"X-Forwarded-For": "5.6.7.8"},
+			expectedIP: "1.2.3.4",
+		},
+		{
+			name:       "rightmost untrusted hop of X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "X-Forwarded-For",
+			headers:    map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.2"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "X-Forwarded-For hops with ports",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "X-Forwarded-For",
+			headers:    map[string]string{"X-Forwarded-For": "5.6.7.8:555, [2001:db8::1]:4711"},
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:       "X-Forwarded-For IPv4 hop with a port",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "X-Forwarded-For",
+			headers:    map[string]string{"X-Forwarded-For": "5.6.7.8:555"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "spoofed X-Forwarded-For is ignored when the proxy sets X-Real-IP",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "X-Real-IP",
+			headers:    map[string]string{"X-Forwarded-For": "9.9.9.9", "X-Real-IP": "5.6.7.8"},
+			expectedIP: "5.6.7.8",
+		},
+		{
+			name:       "missing header falls back to the proxy",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "X-Real-IP",
+			headers:    map[string]string{"X-Forwarded-For": "9.9.9.9"},
+			expectedIP: "10.0.0.1",
+		},
+		{
+			name:       "Forwarded with an IPv6 port",
+			remoteAddr: "[::1]:1000",
+			header:     "Forwarded",
+			headers:    map[string]string{"Forwarded": `for=9.9.9.9, for="[2001:db8::1]:4711";proto=https`},
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:       "Forwarded with an unknown hop",
+			remoteAddr: "10.0.0.1:1000",
+			header:     "Forwarded",
+			headers:    map[string]string{"Forwarded": "for=9.9.9.9, for=unknown"},
+			expectedIP: "10.0.0.1",
+		},
+	}
+
+	for _, test := range tests {
+		clientIPHeader = test.header
+		request := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		ip, err := clientIP(request)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if ip.String() != test.expectedIP {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expectedIP, ip)
+		}
+	}
+}
+
+func TestIPRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name             string
+		ip               string
+		ipv4PrefixLength int
+		ipv6PrefixLength int
+		expectedKey      string
+	}{
+		{
+			name:             "full-length IPv4 prefix",
+			ip:               "1.2.3.4",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 64,
+			expectedKey:      "1.2.3.4",
+		},
+		{
+			name:             "IPv4 /24",
+			ip:               "1.2.3.4",
+			ipv4PrefixLength: 24,
+			ipv6PrefixLength: 64,
+			expectedKey:      "1.2.3.0/24",
+		},
+		{
+			name:             "IPv6 /64",
+			ip:               "2001:db8:1:2:3:4:5:6",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 64,
+			expectedKey:      "2001:db8:1:2::/64",
+		},
+		{
+			name:             "IPv6 /56",
+			ip:               "2001:db8:1:2ff:3:4:5:6",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 56,
+			expectedKey:      "2001:db8:1:200::/56",
+		},
+		{
+			name:             "addresses of the same IPv6 /64 share a key",
+			ip:               "2001:db8:1:2:ffff:ffff:ffff:ffff",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 64,
+			expectedKey:      "2001:db8:1:2::/64",
+		},
+		{
+			name:             "full-length IPv6 prefix",
+			ip:               "2001:db8::1",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 128,
+			expectedKey:      "2001:db8::1",
+		},
+		{
+			name:             "IPv4-mapped IPv6 address is limited as IPv4",
+			ip:               "::ffff:1.2.3.4",
+			ipv4PrefixLength: 32,
+			ipv6PrefixLength: 64,
+			expectedKey:      "1.2.3.4",
+		},
+		{
+			name:             "IPv4-mapped IPv6 address uses the IPv4 prefix length",
+			ip:               "::ffff:1.2.3.4",
+			ipv4PrefixLength: 16,
+			ipv6PrefixLength: 64,
+			expectedKey:      "1.2.0.0/16",
+		},
+	}
+
+	for _, test := range tests {
+		key := ipRateLimitKey(net.ParseIP(test.ip), test.ipv4PrefixLength, test.ipv6PrefixLength)
+		if key != test.expectedKey {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expectedKey, key)
+		}
+	}
+}
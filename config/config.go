@@ -2,10 +2,12 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/kaspanet/faucet/logger"
@@ -18,6 +20,9 @@ import (
 const (
 	defaultLogFilename    = "faucet.log"
 	defaultErrLogFilename = "faucet_err.log"
+
+	defaultSignerLogFilename    = "signer.log"
+	defaultSignerErrLogFilename = "signer_err.log"
 )
 
 var (
@@ -31,22 +36,128 @@ var (
 
 // Config defines the configuration options for the faucet.
 type Config struct {
-	ShowVersion bool    `short:"V" long:"version" description:"Display version information and exit"`
-	LogDir      string  `long:"logdir" description:"Directory to log output."`
-	HTTPListen  string  `long:"listen" description:"HTTP address to listen on default: 0.0.0.0:8081)"`
-	RPCServer   string  `long:"rpcserver" short:"s" description:"RPC server to connect to"`
-	PrivateKey  string  `long:"private-key" description:"Faucet Private key"`
-	DBAddress   string  `long:"dbaddress" description:"Database address" default:"localhost:5432"`
-	DBSSLMode   string  `long:"dbsslmode" description:"Database SSL mode" choice:"disable" choice:"allow" choice:"prefer" choice:"require" choice:"verify-ca" choice:"verify-full" default:"disable"`
-	DBUser      string  `long:"dbuser" description:"Database user" required:"true"`
-	DBPassword  string  `long:"dbpass" description:"Database password" required:"true"`
-	DBName      string  `long:"dbname" description:"Database name" required:"true"`
-	Migrate     bool    `long:"migrate" description:"Migrate the database to the latest version. The server will not start when using this flag."`
-	FeeRate     float64 `long:"fee-rate" description:"Coins per gram fee rate"`
-	TestNet     bool    `long:"testnet" description:"Connect to testnet"`
-	SimNet      bool    `long:"simnet" description:"Connect to the simulation test network"`
-	DevNet      bool    `long:"devnet" description:"Connect to the development test network"`
-	Profile     string  `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
+	ShowVersion bool   `short:"V" long:"version" description:"Display version information and exit"`
+	LogDir      string `long:"logdir" description:"Directory to log output."`
+	HTTPListen  string `long:"listen" description:"HTTP address to listen on default: 0.0.0.0:8081)"`
+	RPCServer   string `long:"rpcserver" short:"s" description:"RPC server to connect to"`
+	KeyfileFlags
+	ExtendedPrivateKey        string             `long:"extended-private-key" description:"Faucet extended private key. Either a master key or a kaspawallet account key, from which fresh change addresses are derived like kaspawallet does"`
+	PrivateKey                string             `long:"private-key" description:"Faucet Private key"`
+	MultisigPublicKeys        []string           `long:"multisig-public-key" description:"Hex Schnorr public key of a cosigner of an m-of-n multisig faucet. Repeat for each of the n cosigners"`
+	MultisigMinimumSignatures uint32             `long:"multisig-minimum-signatures" description:"Number of cosigners (m) that must sign the transactions of a multisig faucet"`
+	MultisigKeyfiles          []string           `long:"multisig-keyfile" description:"Key file of a multisig cosigner that signs in the faucet's process, such as one created by the keygen command. The cosigner's key is the key of the key file's receive address. Decrypted with the key file password. Repeat for several cosigners"`
+	MultisigSignerSockets     []string           `long:"multisig-signer-socket" description:"Unix socket of a signer process of a multisig cosigner. Repeat for several cosigners"`
+	SignerSocket              string             `long:"signer-socket" description:"Unix socket of a signer process, such as the one started by the signer command, that holds the faucet's keys and signs its transactions"`
+	DBAddress                 string             `long:"dbaddress" description:"Database address" default:"localhost:5432"`
+	DBSSLMode                 string             `long:"dbsslmode" description:"Database SSL mode" choice:"disable" choice:"allow" choice:"prefer" choice:"require" choice:"verify-ca" choice:"verify-full" default:"disable"`
+	DBUser                    string             `long:"dbuser" description:"Database user" required:"true"`
+	DBPassword                string             `long:"dbpass" description:"Database password" required:"true"`
+	DBName                    string             `long:"dbname" description:"Database name" required:"true"`
+	Migrate                   bool               `long:"migrate" description:"Migrate the database to the latest version. The server will not start when using this flag."`
+	FeeRate                   float64            `long:"fee-rate" description:"Fee rate in sompi per gram of transaction mass" default:"1"`
+	Amount                    float64            `long:"amount" description:"Amount of KAS sent for a request that doesn't specify one" default:"1"`
+	MinAmount                 float64            `long:"min-amount" description:"Minimum amount of KAS a caller may request using the amount query parameter. Must not be below the dust threshold, which is the minimum when not set"`
+	MaxAmount                 float64            `long:"max-amount" description:"Maximum amount of KAS a caller may request using the amount query parameter. Choosing the amount is disabled when not set"`
+	BalanceScalingThreshold   float64            `long:"balance-scaling-threshold" description:"Spendable balance in KAS below which payouts shrink proportionally to the balance. Disabled when not set"`
+	BatchInterval             time.Duration      `long:"batch-interval" description:"Pay queued requests together in one transaction every given interval (e.g. 10s). Batching is disabled when not set"`
+	BatchMaxRecipients        int                `long:"batch-max-recipients" description:"Maximum number of recipients in a single batch transaction" default:"50"`
+	Consolidate               bool               `long:"consolidate" description:"Merge the faucet's spendable UTXOs into as few UTXOs as possible and exit"`
+	ConsolidationThreshold    int                `long:"consolidation-threshold" description:"Merge the smallest UTXOs in the background whenever the faucet holds more spendable UTXOs than this. Disabled when not set"`
+	FanOutPoolSize            int                `long:"fan-out-pool-size" description:"Keep this many UTXOs, each enough for a single payout, so that concurrent payouts don't wait for each other's change. Disabled when not set"`
+	ChainUnconfirmedChange    bool               `long:"chain-unconfirmed-change" description:"Spend the faucet's own change outputs while their transactions are still unconfirmed, instead of waiting for them to mature"`
+	Confirmations             *uint64            `long:"confirmations" description:"Number of confirmations after which the faucet spends a UTXO, and after which a payout is considered confirmed. Defaults to 10 on mainnet and testnet, and to 0 on devnet and simnet"`
+	CoinbaseSpending          string             `long:"coinbase-spending" description:"Whether the faucet spends coinbase UTXOs once they mature, or never spends them. Defaults to mature" choice:"mature" choice:"exclude"`
+	SpendScore                string             `long:"spend-score" description:"Whether confirmations are counted by the virtual DAA score or by the virtual selected parent blue score. Defaults to daa" choice:"daa" choice:"blue-score"`
+	UTXOSelection             string             `long:"utxo-selection" description:"Strategy for selecting the UTXOs that fund a transaction" choice:"largest-first" choice:"smallest-first" choice:"branch-and-bound" choice:"random" default:"largest-first"`
+	AddressRequestInterval    time.Duration      `long:"address-request-interval" description:"Minimum interval between payouts to the same address, no matter which IPs request them. Disabled when 0" default:"24h"`
+	IPRateLimits              []string           `long:"ip-rate-limit" description:"Quota of an IP per sliding window, either as <requests>/<window> or as <amount>KAS/<window>, such as 3/1h or 10KAS/24h. Repeat to stack several windows, such as 3/1h and 5/24h" default:"1/24h"`
+	IPRateLimitWindows        []*RateLimitWindow `no-flag:"true"`
+	IPv4PrefixLength          int                `long:"ipv4-prefix-length" description:"Prefix length of the IPv4 networks that share a rate limit" default:"32"`
+	IPv6PrefixLength          int                `long:"ipv6-prefix-length" description:"Prefix length of the IPv6 networks that share a rate limit, such as 64 or 56" default:"64"`
+	TrustedProxies            []string           `long:"trusted-proxies" description:"CIDRs of trusted reverse proxies, whose client-ip-header tells the client IP. Comma separated, or repeated"`
+	ClientIPHeader            string             `long:"client-ip-header" description:"Header that the trusted proxies set to the client IP. Other forwarding headers are ignored, since the client may set them" choice:"X-Forwarded-For" choice:"X-Real-IP" choice:"Forwarded" default:"X-Forwarded-For"`
+	LowBalanceThresholds      []float64          `long:"low-balance-threshold" description:"Alert when the spendable balance falls below this many KAS. May be repeated for several thresholds"`
+	LowBalanceHysteresis      float64            `long:"low-balance-hysteresis" description:"Ratio above a threshold that the balance must recover to before the threshold is alerted again" default:"0.1"`
+	AlertWebhook              string             `long:"alert-webhook" description:"URL to post balance alerts to as JSON"`
+	AlertSMTPServer           string             `long:"alert-smtp-server" description:"SMTP server (host:port) to email balance alerts through"`
+	AlertSMTPUser             string             `long:"alert-smtp-user" description:"SMTP user. Authentication is disabled when not set"`
+	AlertSMTPPasswordEnv      string             `long:"alert-smtp-password-env" description:"Environment variable holding the SMTP password" default:"FAUCET_ALERT_SMTP_PASSWORD"`
+	AlertSMTPPasswordFile     string             `long:"alert-smtp-password-file" description:"File holding the SMTP password. Takes precedence over alert-smtp-password-env"`
+	AlertEmailFrom            string             `long:"alert-email-from" description:"Sender address of balance alert emails"`
+	AlertEmailTo              []string           `long:"alert-email-to" description:"Recipient address of balance alert emails. May be repeated"`
+	NetworkFlags
+	Profile string `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
+}
+
+// NetworkFlags are the flags that choose the network.
+type NetworkFlags struct {
+	TestNet bool `long:"testnet" description:"Connect to testnet"`
+	SimNet  bool `long:"simnet" description:"Connect to the simulation test network"`
+	DevNet  bool `long:"devnet" description:"Connect to the development test network"`
+}
+
+// KeyfileFlags are the flags that locate the key file and its password.
+type KeyfileFlags struct {
+	Keyfile             string `long:"keyfile" description:"Path to a password-encrypted key file, such as kaspawallet's keys.json or one created by the keygen command"`
+	KeyfilePasswordEnv  string `long:"keyfile-password-env" description:"Environment variable holding the key file password" default:"FAUCET_KEYFILE_PASSWORD"`
+	KeyfilePasswordFile string `long:"keyfile-password-file" description:"File holding the key file password. Takes precedence over keyfile-password-env"`
+}
+
+// KeyfilePassword returns the key file password from the password
+// file if one is set, or from the password environment variable.
+func (flags *KeyfileFlags) KeyfilePassword() (string, error) {
+	return readSecret("key file password", flags.KeyfilePasswordFile, "keyfile-password-file",
+		flags.KeyfilePasswordEnv)
+}
+
+// AlertSMTPPassword returns the SMTP password from the password file if
+// one is set, or from the password environment variable.
+func (cfg *Config) AlertSMTPPassword() (string, error) {
+	return readSecret("SMTP password", cfg.AlertSMTPPasswordFile, "alert-smtp-password-file",
+		cfg.AlertSMTPPasswordEnv)
+}
+
+// readSecret returns the secret of the given name from the given file,
+// without its trailing newline, if the file is set, or from the given
+// environment variable. Secrets aren't accepted as flags, since those
+// show up in the process list and in the shell history.
+func readSecret(name string, file string, fileFlag string, env string) (string, error) {
+	if file != "" {
+		secret, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read the %s", name)
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	}
+	secret, ok := os.LookupEnv(env)
+	if !ok {
+		return "", errors.Errorf("the %s is not set. Set it in the %s environment variable "+
+			"or in a file passed with --%s", name, env, fileFlag)
+	}
+	return secret, nil
+}
+
+// KeygenConfig defines the configuration options for the keygen command.
+type KeygenConfig struct {
+	KeyfileFlags
+	Force bool `long:"force" description:"Overwrite the key file if it already exists"`
+	NetworkFlags
+}
+
+// SignerConfig defines the configuration options for the signer command.
+type SignerConfig struct {
+	LogDir string `long:"logdir" description:"Directory to log output."`
+	Socket string `long:"socket" description:"Path of the Unix socket to listen on, in a directory that only the current user may access" required:"true"`
+	KeyfileFlags
+	NetworkFlags
+}
+
+// RateLimitWindow limits the requests of an IP within a sliding window,
+// either to a number of requests or to an amount of KAS.
+type RateLimitWindow struct {
+	Window      time.Duration
+	MaxRequests int
+	MaxAmount   float64
 }
 
 var cfg *Config
@@ -76,15 +187,98 @@ func Parse() error {
 		if cfg.RPCServer == "" {
 			return errors.New("rpcserver argument is required when --migrate flag is not raised")
 		}
-		if cfg.PrivateKey == "" {
-			return errors.New("private-key argument is required when --migrate flag is not raised")
+		keyCount := 0
+		for _, key := range []string{cfg.PrivateKey, cfg.ExtendedPrivateKey, cfg.Keyfile, cfg.SignerSocket} {
+			if key != "" {
+				keyCount++
+			}
+		}
+		if len(cfg.MultisigPublicKeys) > 0 {
+			keyCount++
+		}
+		if keyCount != 1 {
+			return errors.New("exactly one of the private-key, extended-private-key, keyfile, signer-socket " +
+				"and multisig-public-key arguments is required when --migrate flag is not raised")
+		}
+		if len(cfg.MultisigPublicKeys) > 0 {
+			if cfg.MultisigMinimumSignatures == 0 || cfg.MultisigMinimumSignatures > uint32(len(cfg.MultisigPublicKeys)) {
+				return errors.New("multisig-minimum-signatures must be between 1 and the number of multisig-public-key arguments")
+			}
+			if uint32(len(cfg.MultisigKeyfiles)+len(cfg.MultisigSignerSockets)) < cfg.MultisigMinimumSignatures {
+				return errors.New("at least multisig-minimum-signatures multisig-keyfile and multisig-signer-socket " +
+					"arguments are required")
+			}
+		} else if len(cfg.MultisigKeyfiles) > 0 || len(cfg.MultisigSignerSockets) > 0 ||
+			cfg.MultisigMinimumSignatures != 0 {
+
+			return errors.New("multisig-keyfile, multisig-signer-socket and multisig-minimum-signatures " +
+				"require multisig-public-key")
+		}
+	}
+
+	if cfg.FeeRate < 0 {
+		return errors.New("fee-rate cannot be negative")
+	}
+
+	if cfg.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if cfg.MinAmount < 0 || cfg.MaxAmount < 0 {
+		return errors.New("min-amount and max-amount cannot be negative")
+	}
+	if cfg.MaxAmount != 0 && cfg.MinAmount > cfg.MaxAmount {
+		return errors.New("min-amount cannot be greater than max-amount")
+	}
+	if cfg.BalanceScalingThreshold < 0 {
+		return errors.New("balance-scaling-threshold cannot be negative")
+	}
+
+	for _, threshold := range cfg.LowBalanceThresholds {
+		if threshold <= 0 {
+			return errors.New("low-balance-threshold must be positive")
+		}
+	}
+	if cfg.LowBalanceHysteresis < 0 {
+		return errors.New("low-balance-hysteresis cannot be negative")
+	}
+	if cfg.AlertSMTPServer != "" && (cfg.AlertEmailFrom == "" || len(cfg.AlertEmailTo) == 0) {
+		return errors.New("alert-email-from and alert-email-to are required when alert-smtp-server is set")
+	}
+
+	if cfg.ConsolidationThreshold < 0 {
+		return errors.New("consolidation-threshold cannot be negative")
+	}
+	if cfg.FanOutPoolSize < 0 {
+		return errors.New("fan-out-pool-size cannot be negative")
+	}
+	cfg.IPRateLimitWindows = make([]*RateLimitWindow, len(cfg.IPRateLimits))
+	for i, rateLimit := range cfg.IPRateLimits {
+		cfg.IPRateLimitWindows[i], err = parseRateLimitWindow(rateLimit)
+		if err != nil {
+			return err
 		}
 	}
+	if cfg.IPv4PrefixLength < 0 || cfg.IPv4PrefixLength > 32 {
+		return errors.New("ipv4-prefix-length must be between 0 and 32")
+	}
+	if cfg.IPv6PrefixLength < 0 || cfg.IPv6PrefixLength > 128 {
+		return errors.New("ipv6-prefix-length must be between 0 and 128")
+	}
+	if cfg.AddressRequestInterval < 0 {
+		return errors.New("address-request-interval cannot be negative")
+	}
+	if cfg.BatchInterval < 0 {
+		return errors.New("batch-interval cannot be negative")
+	}
+	if cfg.BatchMaxRecipients <= 0 {
+		return errors.New("batch-max-recipients must be positive")
+	}
 
-	err = resolveNetwork(cfg)
+	err = resolveNetwork(&cfg.NetworkFlags)
 	if err != nil {
 		return err
 	}
+	resolveSpendPolicy(cfg)
 
 	if cfg.Profile != "" {
 		profilePort, err := strconv.Atoi(cfg.Profile)
@@ -105,7 +299,83 @@ func Parse() error {
 	return nil
 }
 
-func resolveNetwork(cfg *Config) error {
+// parseRateLimitWindow parses a rate limit of the form <requests>/<window>
+// or <amount>KAS/<window>.
+func parseRateLimitWindow(rateLimit string) (*RateLimitWindow, error) {
+	slash := strings.LastIndex(rateLimit, "/")
+	if slash < 0 {
+		return nil, errors.Errorf("ip-rate-limit %s is not of the form <quota>/<window>", rateLimit)
+	}
+	quota, windowString := strings.TrimSpace(rateLimit[:slash]), strings.TrimSpace(rateLimit[slash+1:])
+	window, err := time.ParseDuration(windowString)
+	if err != nil || window <= 0 {
+		return nil, errors.Errorf("ip-rate-limit %s has an invalid window %s", rateLimit, windowString)
+	}
+
+	rateLimitWindow := &RateLimitWindow{Window: window}
+	if strings.HasSuffix(strings.ToUpper(quota), "KAS") {
+		amountString := strings.TrimSpace(quota[:len(quota)-len("KAS")])
+		rateLimitWindow.MaxAmount, err = strconv.ParseFloat(amountString, 64)
+		if err != nil || rateLimitWindow.MaxAmount <= 0 {
+			return nil, errors.Errorf("ip-rate-limit %s has an invalid amount %s", rateLimit, amountString)
+		}
+		return rateLimitWindow, nil
+	}
+	rateLimitWindow.MaxRequests, err = strconv.Atoi(quota)
+	if err != nil || rateLimitWindow.MaxRequests <= 0 {
+		return nil, errors.Errorf("ip-rate-limit %s has an invalid number of requests %s", rateLimit, quota)
+	}
+	return rateLimitWindow, nil
+}
+
+// ParseKeygen parses the arguments of the keygen command.
+func ParseKeygen(args []string) (*KeygenConfig, error) {
+	keygenConfig := &KeygenConfig{}
+	parser := flags.NewParser(keygenConfig, flags.HelpFlag)
+	parser.Usage = "keygen [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if keygenConfig.Keyfile == "" {
+		return nil, errors.New("the keyfile argument is required")
+	}
+	err = resolveNetwork(&keygenConfig.NetworkFlags)
+	if err != nil {
+		return nil, err
+	}
+	return keygenConfig, nil
+}
+
+// ParseSigner parses the arguments of the signer command, and
+// initializes its log.
+func ParseSigner(args []string) (*SignerConfig, error) {
+	signerConfig := &SignerConfig{LogDir: defaultLogDir}
+	parser := flags.NewParser(signerConfig, flags.HelpFlag)
+	parser.Usage = "signer [OPTIONS]"
+	_, err := parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if signerConfig.Keyfile == "" {
+		return nil, errors.New("the keyfile argument is required")
+	}
+	err = resolveNetwork(&signerConfig.NetworkFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile := filepath.Join(signerConfig.LogDir, defaultSignerLogFilename)
+	errLogFile := filepath.Join(signerConfig.LogDir, defaultSignerErrLogFilename)
+	logger.InitLog(logFile, errLogFile)
+	err = logger.SetLogLevels("debug")
+	if err != nil {
+		return nil, err
+	}
+	return signerConfig, nil
+}
+
+func resolveNetwork(cfg *NetworkFlags) error {
 	// Multiple networks can't be selected simultaneously.
 	numNets := 0
 	if cfg.TestNet {
@@ -135,6 +405,37 @@ func resolveNetwork(cfg *Config) error {
 	return nil
 }
 
+// spendPolicyDefaults are the spend policy settings used on a network
+// unless they're set explicitly.
+type spendPolicyDefaults struct {
+	confirmations    uint64
+	coinbaseSpending string
+	spendScore       string
+}
+
+var networkSpendPolicyDefaults = map[string]spendPolicyDefaults{
+	dagconfig.MainnetParams.Name: {confirmations: 10, coinbaseSpending: "mature", spendScore: "daa"},
+	dagconfig.TestnetParams.Name: {confirmations: 10, coinbaseSpending: "mature", spendScore: "daa"},
+	dagconfig.DevnetParams.Name:  {confirmations: 0, coinbaseSpending: "mature", spendScore: "daa"},
+	dagconfig.SimnetParams.Name:  {confirmations: 0, coinbaseSpending: "mature", spendScore: "daa"},
+}
+
+// resolveSpendPolicy fills the spend policy settings that weren't set
+// with the defaults of the active network.
+func resolveSpendPolicy(cfg *Config) {
+	defaults := networkSpendPolicyDefaults[activeNetParams.Name]
+	if cfg.Confirmations == nil {
+		confirmations := defaults.confirmations
+		cfg.Confirmations = &confirmations
+	}
+	if cfg.CoinbaseSpending == "" {
+		cfg.CoinbaseSpending = defaults.coinbaseSpending
+	}
+	if cfg.SpendScore == "" {
+		cfg.SpendScore = defaults.spendScore
+	}
+}
+
 // MainConfig is a getter to the main config
 func MainConfig() (*Config, error) {
 	if cfg == nil {
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+)
+
+func TestResolveSpendPolicy(t *testing.T) {
+	tests := []struct {
+		params                   *dagconfig.Params
+		expectedConfirmations    uint64
+		expectedCoinbaseSpending string
+		expectedSpendScore       string
+	}{
+		{
+			params:                   &dagconfig.MainnetParams,
+			expectedConfirmations:    10,
+			expectedCoinbaseSpending: "mature",
+			expectedSpendScore:       "daa",
+		},
+		{
+			params:                   &dagconfig.TestnetParams,
+			expectedConfirmations:    10,
+			expectedCoinbaseSpending: "mature",
+			expectedSpendScore:       "daa",
+		},
+		{
+			params:                   &dagconfig.DevnetParams,
+			expectedConfirmations:    0,
+			expectedCoinbaseSpending: "mature",
+			expectedSpendScore:       "daa",
+		},
+		{
+			params:                   &dagconfig.SimnetParams,
+			expectedConfirmations:    0,
+			expectedCoinbaseSpending: "mature",
+			expectedSpendScore:       "daa",
+		},
+	}
+
+	for _, test := range tests {
+		activeNetParams = test.params
+
+		cfg := &Config{}
+		resolveSpendPolicy(cfg)
+		if cfg.Confirmations == nil || *cfg.Confirmations != test.expectedConfirmations {
+			t.Errorf("%s: expected %d confirmations, got %v",
+				test.params.Name, test.expectedConfirmations, cfg.Confirmations)
+		}
+		if cfg.CoinbaseSpending != test.expectedCoinbaseSpending {
+			t.Errorf("%s: expected coinbase spending %s, got %s",
+				test.params.Name, test.expectedCoinbaseSpending, cfg.CoinbaseSpending)
+		}
+		if cfg.SpendScore != test.expectedSpendScore {
+			t.Errorf("%s: expected spend score %s, got %s",
+				test.params.Name, test.expectedSpendScore, cfg.SpendScore)
+		}
+
+		// Settings that were set explicitly are kept as is
+		confirmations := uint64(3)
+		cfg = &Config{Confirmations: &confirmations, CoinbaseSpending: "exclude", SpendScore: "blue-score"}
+		resolveSpendPolicy(cfg)
+		if *cfg.Confirmations != 3 || cfg.CoinbaseSpending != "exclude" || cfg.SpendScore != "blue-score" {
+			t.Errorf("%s: explicit settings were overridden: %d, %s, %s",
+				test.params.Name, *cfg.Confirmations, cfg.CoinbaseSpending, cfg.SpendScore)
+		}
+	}
+}
+
+func TestAlertSMTPPassword(t *testing.T) {
+	const env = "FAUCET_TEST_ALERT_SMTP_PASSWORD"
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err := ioutil.WriteFile(passwordFile, []byte("from file\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing the password file: %s", err)
+	}
+
+	cfg := &Config{AlertSMTPPasswordEnv: env}
+	_, err = cfg.AlertSMTPPassword()
+	if err == nil {
+		t.Errorf("Expected an error while the password isn't set")
+	}
+
+	os.Setenv(env, "from env")
+	defer os.Unsetenv(env)
+	password, err := cfg.AlertSMTPPassword()
+	if err != nil || password != "from env" {
+		t.Errorf("Expected the password from the environment, got %q and %v", password, err)
+	}
+
+	cfg.AlertSMTPPasswordFile = passwordFile
+	password, err = cfg.AlertSMTPPassword()
+	if err != nil || password != "from file" {
+		t.Errorf("Expected the password from the file, got %q and %v", password, err)
+	}
+}
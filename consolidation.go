@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/constants"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/kaspanet/kaspad/domain/miningmanager/mempool"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+// consolidationInterval is the interval between checks of whether
+// the wallet holds too many UTXOs.
+const consolidationInterval = 10 * time.Minute
+
+// consolidateUTXOs merges the smallest spendable UTXOs of the wallet,
+// one transaction at a time, until at most targetUTXOCount spendable
+// UTXOs remain. UTXOs of poolAmount are pool UTXOs, which are neither
+// merged nor counted. A poolAmount of zero means there's no pool. It
+// returns the number of submitted transactions.
+func consolidateUTXOs(client *rpcclient.RPCClient, targetUTXOCount int, poolAmount uint64) (int, error) {
+	cfg, err := config.MainConfig()
+	if err != nil {
+		return 0, err
+	}
+	if targetUTXOCount < 1 {
+		targetUTXOCount = 1
+	}
+
+	transactionCount := 0
+	for {
+		domainTransaction, err := buildSignedTransaction(
+			func(availableUTXOs []*appmessage.UTXOsByAddressesEntry, changeAddress util.Address) (
+				*externalapi.DomainTransaction, error) {
+
+				utxos := make([]*appmessage.UTXOsByAddressesEntry, 0, len(availableUTXOs))
+				for _, entry := range availableUTXOs {
+					if poolAmount == 0 || entry.UTXOEntry.Amount != poolAmount {
+						utxos = append(utxos, entry)
+					}
+				}
+				if len(utxos) <= targetUTXOCount {
+					return nil, nil
+				}
+				sort.Slice(utxos, func(i, j int) bool {
+					return utxos[i].UTXOEntry.Amount < utxos[j].UTXOEntry.Amount
+				})
+				// Merging n UTXOs into one reduces the UTXO count by n-1
+				maxInputCount := len(utxos) - targetUTXOCount + 1
+				return generateConsolidationTransaction(utxos[:maxInputCount], changeAddress, cfg.FeeRate)
+			})
+		if err != nil {
+			return transactionCount, err
+		}
+		if domainTransaction == nil {
+			return transactionCount, nil
+		}
+
+		rpcTransaction := appmessage.DomainTransactionToRPCTransaction(domainTransaction)
+		transactionID, err := sendTransaction(client, rpcTransaction)
+		if err != nil {
+			faucetWallet.release(domainTransaction)
+			return transactionCount, err
+		}
+		submittedTransactions.track(transactionID, domainTransaction, nil, 1)
+		transactionCount++
+		log.Infof("Submitted consolidation transaction %s merging %d UTXOs",
+			transactionID, len(domainTransaction.Inputs))
+	}
+}
+
+// generateConsolidationTransaction builds an unsigned transaction that
+// spends as many of the given UTXOs as fit under the maximum standard
+// transaction mass, and pays them back to the given change address in a
+// single output. It returns nil if less than two UTXOs can be merged.
+func generateConsolidationTransaction(utxos []*appmessage.UTXOsByAddressesEntry, changeAddress util.Address,
+	feeRate float64) (*externalapi.DomainTransaction, error) {
+
+	fromScript, err := txscript.PayToAddrScript(changeAddress)
+	if err != nil {
+		return nil, err
+	}
+	// The transaction is estimated with dummy signature scripts of the
+	// right size, so that it doesn't need to be signed for every input
+	// that is added.
+	estimatedTransaction := &externalapi.DomainTransaction{
+		Version:      constants.MaxTransactionVersion,
+		Outputs:      []*externalapi.DomainTransactionOutput{{Value: 0, ScriptPublicKey: fromScript}},
+		SubnetworkID: subnetworks.SubnetworkIDNative,
+	}
+
+	selectedUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0, len(utxos))
+	estimatedMass := uint64(0)
+	totalValue := uint64(0)
+	for _, utxo := range utxos {
+		input, err := utxoToInput(utxo)
+		if err != nil {
+			return nil, err
+		}
+		input.SignatureScript = make([]byte, faucetKeys.signatureScriptSize)
+		estimatedTransaction.Inputs = append(estimatedTransaction.Inputs, input)
+
+		mass := calculateTransactionMass(estimatedTransaction)
+		if mass > mempool.MaximumStandardTransactionMass {
+			break
+		}
+		estimatedMass = mass
+		selectedUTXOs = append(selectedUTXOs, utxo)
+		totalValue += utxo.UTXOEntry.Amount
+	}
+	if len(selectedUTXOs) < 2 {
+		return nil, nil
+	}
+
+	fee := calculateFee(estimatedMass, feeRate)
+	if fee >= totalValue {
+		return nil, errors.Errorf("The fee %d for consolidating %d UTXOs exceeds their total value %d",
+			fee, len(selectedUTXOs), totalValue)
+	}
+	return generateUnsignedTransaction(selectedUTXOs, nil, changeAddress, totalValue-fee)
+}
+
+// runConsolidation merges all the faucet's spendable UTXOs into as few
+// UTXOs as possible. It's used by the --consolidate flag.
+func runConsolidation(cfg *config.Config) error {
+	client, err := rpcclient.NewRPCClient(cfg.RPCServer)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := client.Close()
+		if err != nil {
+			log.Errorf("Error closing the RPC client: %s", err)
+		}
+	}()
+
+	err = resyncWallet(client)
+	if err != nil {
+		return err
+	}
+	transactionCount, err := consolidateUTXOs(client, 1, 0)
+	if err != nil {
+		return err
+	}
+	log.Infof("Submitted %d consolidation transactions", transactionCount)
+	return nil
+}
+
+// consolidationLoop periodically consolidates the wallet whenever it
+// holds more spendable UTXOs than the given threshold, down to half
+// of the threshold. Pool UTXOs of poolAmount are left alone.
+func consolidationLoop(threshold int, poolAmount uint64) {
+	for range time.Tick(consolidationInterval) {
+		client, err := faucetRPCConnection.connectedClient()
+		if err != nil {
+			continue
+		}
+		if faucetWallet.spendableUTXOCount(poolAmount) <= threshold {
+			continue
+		}
+		transactionCount, err := consolidateUTXOs(client, threshold/2, poolAmount)
+		if err != nil {
+			log.Errorf("Error consolidating UTXOs: %s", err)
+		}
+		log.Infof("Submitted %d consolidation transactions", transactionCount)
+	}
+}
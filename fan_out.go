@@ -0,0 +1,171 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/constants"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/kaspanet/kaspad/util"
+)
+
+const (
+	// fanOutInterval is the interval between checks of whether
+	// the UTXO pool needs refilling.
+	fanOutInterval = time.Minute
+
+	// maxFanOutOutputsPerTransaction bounds the number of pool UTXOs
+	// created by a single transaction, keeping it well under the
+	// maximum standard transaction mass.
+	maxFanOutOutputsPerTransaction = 100
+)
+
+// utxoPool keeps a pool of equal-size UTXOs, each enough for a single
+// payout, so that concurrent payouts can each be funded by a single
+// confirmed input instead of waiting for change from each other.
+type utxoPool struct {
+	size   int
+	amount uint64
+
+	// pendingTransactions maps fan-out transactions that weren't
+	// accepted yet to the number of pool UTXOs they create.
+	pendingTransactions map[string]int
+}
+
+// newUTXOPool returns a pool of the given size. Every UTXO in the pool is
+// enough to pay the default amount and the fee of a transaction with a
+// single input and a single output.
+func newUTXOPool(size int, feeRate float64) (*utxoPool, error) {
+	script, err := txscript.PayToAddrScript(faucetAddress)
+	if err != nil {
+		return nil, err
+	}
+	estimatedTransaction := &externalapi.DomainTransaction{
+		Version: constants.MaxTransactionVersion,
+		Inputs: []*externalapi.DomainTransactionInput{{
+			SignatureScript: make([]byte, faucetKeys.signatureScriptSize),
+			SigOpCount:      faucetKeys.sigOpCount,
+		}},
+		Outputs:      []*externalapi.DomainTransactionOutput{{ScriptPublicKey: script}},
+		SubnetworkID: subnetworks.SubnetworkIDNative,
+	}
+	fee := calculateFee(calculateTransactionMass(estimatedTransaction), feeRate)
+	return &utxoPool{
+		size:                size,
+		amount:              payout.defaultAmount + fee,
+		pendingTransactions: make(map[string]int),
+	}, nil
+}
+
+// pendingUTXOCount returns the number of pool UTXOs that are created by
+// fan-out transactions that weren't accepted yet, and forgets the
+// fan-out transactions that were accepted or dropped.
+func (p *utxoPool) pendingUTXOCount() int {
+	count := 0
+	for transactionID, outputCount := range p.pendingTransactions {
+		if !submittedTransactions.isPending(transactionID) {
+			delete(p.pendingTransactions, transactionID)
+			continue
+		}
+		count += outputCount
+	}
+	return count
+}
+
+// refill splits large UTXOs into pool UTXOs until the wallet holds, or
+// is about to hold, the pool's size of them.
+func (p *utxoPool) refill(client *rpcclient.RPCClient) error {
+	cfg, err := config.MainConfig()
+	if err != nil {
+		return err
+	}
+
+	for {
+		missingCount := p.size - faucetWallet.utxoCountWithAmount(p.amount) - p.pendingUTXOCount()
+		if missingCount <= 0 {
+			return nil
+		}
+		if missingCount > maxFanOutOutputsPerTransaction {
+			missingCount = maxFanOutOutputsPerTransaction
+		}
+
+		payments := make([]*payment, missingCount)
+		for i := range payments {
+			payments[i] = &payment{address: faucetAddress, amount: p.amount}
+		}
+		domainTransaction, err := buildSignedTransaction(
+			func(availableUTXOs []*appmessage.UTXOsByAddressesEntry, changeAddress util.Address) (
+				*externalapi.DomainTransaction, error) {
+
+				// UTXOs that are already in the pool are never split
+				largeUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0, len(availableUTXOs))
+				for _, entry := range availableUTXOs {
+					if entry.UTXOEntry.Amount != p.amount {
+						largeUTXOs = append(largeUTXOs, entry)
+					}
+				}
+				return generateTransactionWithFee(largeUTXOs, payments, changeAddress, cfg.FeeRate)
+			})
+		if err != nil {
+			return err
+		}
+
+		rpcTransaction := appmessage.DomainTransactionToRPCTransaction(domainTransaction)
+		transactionID, err := sendTransaction(client, rpcTransaction)
+		if err != nil {
+			faucetWallet.release(domainTransaction)
+			return err
+		}
+		submittedTransactions.track(transactionID, domainTransaction, nil, 1)
+		p.pendingTransactions[transactionID] = missingCount
+		log.Infof("Submitted fan-out transaction %s creating %d pool UTXOs", transactionID, missingCount)
+	}
+}
+
+// fanOutLoop periodically refills the given UTXO pool.
+func fanOutLoop(pool *utxoPool) {
+	for range time.Tick(fanOutInterval) {
+		client, err := faucetRPCConnection.connectedClient()
+		if err != nil {
+			continue
+		}
+		err = pool.refill(client)
+		if err != nil {
+			log.Errorf("Error refilling the UTXO pool: %s", err)
+		}
+	}
+}
+
+// poolSelector funds payments that fit in a single pool UTXO with
+// exactly one such UTXO, so that concurrent payouts don't compete
+// over the same large UTXOs. Leftovers that are not worth a change
+// output, or that would be dust, go to the fee. Other payments are
+// funded using fallback.
+type poolSelector struct {
+	poolAmount    uint64
+	costOfChange  uint64
+	dustThreshold uint64
+	fallback      UTXOSelector
+}
+
+func (s *poolSelector) SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	[]*appmessage.UTXOsByAddressesEntry, uint64, error) {
+
+	if totalToSpend <= s.poolAmount {
+		for _, entry := range utxos {
+			if entry.UTXOEntry.Amount != s.poolAmount {
+				continue
+			}
+			change := s.poolAmount - totalToSpend
+			if change <= s.costOfChange || change < s.dustThreshold {
+				change = 0
+			}
+			return []*appmessage.UTXOsByAddressesEntry{entry}, change, nil
+		}
+	}
+	return s.fallback.SelectUTXOs(utxos, totalToSpend)
+}
@@ -2,158 +2,370 @@ package main
 
 import (
 	"encoding/hex"
+	"math"
 
 	"github.com/kaspanet/kaspad/domain/consensus/utils/utxo"
 
 	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/signer"
 	"github.com/kaspanet/kaspad/app/appmessage"
 	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
-	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/constants"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/transactionid"
 	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/kaspanet/kaspad/domain/miningmanager/mempool"
 	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
 	"github.com/kaspanet/kaspad/util"
+	"github.com/kaspanet/kaspad/util/txmass"
 	"github.com/pkg/errors"
 )
 
-const (
-	sendAmountKaspa       = 1
-	feeSompis             = 3000
-	requiredConfirmations = 10
-)
-
-func sendToAddress(address util.Address) (string, error) {
-	cfg, err := config.MainConfig()
-	if err != nil {
-		return "", err
+// processPayoutRequests pays the given requests in a single transaction
+// and records the outcome in them.
+func processPayoutRequests(client *rpcclient.RPCClient, requests []*payoutRequest) error {
+	requestedPayments := make([]*payment, len(requests))
+	for i, request := range requests {
+		requestedPayments[i] = &payment{
+			address:     request.address,
+			amount:      request.requestedAmount,
+			ip:          request.ip,
+			usageClaims: request.usageClaims,
+		}
 	}
-	client, err := rpcclient.NewRPCClient(cfg.RPCServer)
+	transactionID, payments, err := sendPayments(client, requestedPayments)
 	if err != nil {
-		return "", err
+		failPayoutRequests(requests, err)
+		return err
 	}
-	utxos, err := fetchSpendableUTXOs(client)
-	if err != nil {
-		return "", err
+
+	amounts := make([]uint64, len(payments))
+	for i, payment := range payments {
+		amounts[i] = payment.amount
 	}
+	payoutRequests.setSubmitted(requests, amounts, transactionID)
+	for i, request := range requests {
+		for _, claim := range request.usageClaims {
+			err := claim.commit(amounts[i])
+			if err != nil {
+				log.Errorf("Error committing a rate limit claim of request %s: %s", request.id, err)
+			}
+		}
+	}
+	return nil
+}
 
-	sendAmountSompi := uint64(sendAmountKaspa * constants.SompiPerKaspa)
-	totalToSend := sendAmountSompi + feeSompis
-	selectedUTXOs, changeSompi, err := selectUTXOs(utxos, totalToSend)
-	if err != nil {
-		return "", err
+// failPayoutRequests marks the given requests as failed with the given
+// error, and rolls back the rate limit slots they claimed.
+func failPayoutRequests(requests []*payoutRequest, err error) {
+	payoutRequests.setFailed(requests, err)
+	for _, request := range requests {
+		rollbackUsageClaims(request.usageClaims)
 	}
+}
 
-	rpcTransaction, err := generateTransaction(selectedUTXOs, sendAmountSompi, changeSompi, address)
-	if err != nil {
-		return "", err
+func rollbackUsageClaims(claims []usageClaim) {
+	for _, claim := range claims {
+		err := claim.rollback()
+		if err != nil {
+			log.Errorf("Error rolling back a rate limit claim: %s", err)
+		}
 	}
+}
 
-	return sendTransaction(client, rpcTransaction)
+// sendPayments pays all the requested payments in a single transaction,
+// after scaling their amounts according to the faucet balance. It returns
+// the ID of the submitted transaction and the payments that were actually made.
+func sendPayments(client *rpcclient.RPCClient, requestedPayments []*payment) (string, []*payment, error) {
+	return submitPayments(client, requestedPayments, 1)
 }
 
-func fetchSpendableUTXOs(client *rpcclient.RPCClient) ([]*appmessage.UTXOsByAddressesEntry, error) {
-	getUTXOsByAddressesResponse, err := client.GetUTXOsByAddresses([]string{faucetAddress.EncodeAddress()})
+// submitPayments is like sendPayments, but also records which attempt to
+// pay the requested payments the submitted transaction is. The amounts of
+// later attempts are final, and aren't scaled again.
+func submitPayments(client *rpcclient.RPCClient, requestedPayments []*payment, attempt int) (
+	string, []*payment, error) {
+
+	cfg, err := config.MainConfig()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	virtualSelectedParentBlueScoreResponse, err := client.GetVirtualSelectedParentBlueScore()
+	payments := make([]*payment, len(requestedPayments))
+	domainTransaction, err := buildSignedTransaction(
+		func(availableUTXOs []*appmessage.UTXOsByAddressesEntry, changeAddress util.Address) (
+			*externalapi.DomainTransaction, error) {
+
+			balance := totalAmount(availableUTXOs)
+			for i, requestedPayment := range requestedPayments {
+				amount := requestedPayment.amount
+				// Resubmitted payments were already scaled when first submitted
+				if attempt == 1 {
+					amount = payout.scaleByBalance(amount, balance)
+				}
+				if amount == 0 {
+					return nil, errors.New("The faucet balance is too low")
+				}
+				scaledPayment := *requestedPayment
+				scaledPayment.amount = amount
+				payments[i] = &scaledPayment
+			}
+			return generateTransactionWithFee(availableUTXOs, payments, changeAddress, cfg.FeeRate)
+		})
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	virtualSelectedParentBlueScore := virtualSelectedParentBlueScoreResponse.BlueScore
 
-	spendableUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0)
-	for _, entry := range getUTXOsByAddressesResponse.Entries {
-		if !isUTXOSpendable(entry, virtualSelectedParentBlueScore) {
-			continue
-		}
-		spendableUTXOs = append(spendableUTXOs, entry)
+	rpcTransaction := appmessage.DomainTransactionToRPCTransaction(domainTransaction)
+	transactionID, err := sendTransaction(client, rpcTransaction)
+	if err != nil {
+		faucetWallet.release(domainTransaction)
+		return "", nil, err
 	}
-	return spendableUTXOs, nil
+	submittedTransactions.track(transactionID, domainTransaction, payments, attempt)
+	return transactionID, payments, nil
 }
 
-func isUTXOSpendable(entry *appmessage.UTXOsByAddressesEntry, virtualSelectedParentBlueScore uint64) bool {
-	blockDAAScore := entry.UTXOEntry.BlockDAAScore
-	if !entry.UTXOEntry.IsCoinbase {
-		return blockDAAScore+requiredConfirmations < virtualSelectedParentBlueScore
+// buildSignedTransaction is like buildTransactionWithChange, but also signs
+// the built transaction. Since signing may take a round trip to a remote
+// signer, it's done after the wallet is unlocked, and the inputs of the
+// transaction are released if it fails.
+func buildSignedTransaction(build func(availableUTXOs []*appmessage.UTXOsByAddressesEntry,
+	changeAddress util.Address) (*externalapi.DomainTransaction, error)) (*externalapi.DomainTransaction, error) {
+
+	domainTransaction, err := buildTransactionWithChange(build)
+	if err != nil || domainTransaction == nil {
+		return nil, err
+	}
+	err = signTransaction(domainTransaction)
+	if err != nil {
+		faucetWallet.release(domainTransaction)
+		return nil, err
 	}
-	coinbaseMaturity := config.ActiveNetParams().BlockCoinbaseMaturity
-	return blockDAAScore+coinbaseMaturity < virtualSelectedParentBlueScore
+	return domainTransaction, nil
 }
 
-func selectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
-	selectedUTXOs []*appmessage.UTXOsByAddressesEntry, changeSompi uint64, err error) {
+// buildTransactionWithChange is like wallet.buildTransaction, but also
+// passes build the address that change should be paid to. The address is
+// only used up if the built transaction pays to it, so that failed builds
+// and transactions without change don't waste change addresses.
+func buildTransactionWithChange(build func(availableUTXOs []*appmessage.UTXOsByAddressesEntry,
+	changeAddress util.Address) (*externalapi.DomainTransaction, error)) (*externalapi.DomainTransaction, error) {
 
-	selectedUTXOs = []*appmessage.UTXOsByAddressesEntry{}
-	totalValue := uint64(0)
+	return faucetWallet.buildTransaction(
+		func(availableUTXOs []*appmessage.UTXOsByAddressesEntry) (*externalapi.DomainTransaction, error) {
+			changeAddress := faucetKeys.changeAddress()
+			domainTransaction, err := build(availableUTXOs, changeAddress)
+			if err != nil || domainTransaction == nil {
+				return nil, err
+			}
+			changeScript, err := txscript.PayToAddrScript(changeAddress)
+			if err != nil {
+				return nil, err
+			}
+			for _, output := range domainTransaction.Outputs {
+				if output.ScriptPublicKey.Equal(changeScript) {
+					err := faucetKeys.useChangeAddress(changeAddress)
+					if err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+			return domainTransaction, nil
+		})
+}
 
-	for _, utxo := range utxos {
-		selectedUTXOs = append(selectedUTXOs, utxo)
-		totalValue += utxo.UTXOEntry.Amount
+// payment is a single output paid by a faucet transaction.
+type payment struct {
+	address util.Address
+	amount  uint64
 
-		if totalValue >= totalToSpend {
-			break
-		}
-	}
+	// ip is the IP address that requested the payment.
+	ip string
 
-	if totalValue < totalToSpend {
-		return nil, 0, errors.Errorf("Insufficient funds for send: %f required, while only %f available",
-			float64(totalToSpend)/constants.SompiPerKaspa, float64(totalValue)/constants.SompiPerKaspa)
+	// usageClaims are the rate limit slots claimed for the payment.
+	// They're freed if the payment eventually fails.
+	usageClaims []usageClaim
+}
+
+func totalPaymentsAmount(payments []*payment) uint64 {
+	total := uint64(0)
+	for _, payment := range payments {
+		total += payment.amount
 	}
+	return total
+}
 
-	return selectedUTXOs, totalValue - totalToSpend, nil
+func totalAmount(utxos []*appmessage.UTXOsByAddressesEntry) uint64 {
+	total := uint64(0)
+	for _, entry := range utxos {
+		total += entry.UTXOEntry.Amount
+	}
+	return total
 }
 
-func generateTransaction(selectedUTXOs []*appmessage.UTXOsByAddressesEntry,
-	sompisToSend uint64, change uint64, toAddress util.Address) (*appmessage.RPCTransaction, error) {
+// generateTransactionWithFee selects UTXOs and builds an unsigned
+// transaction whose fee covers its own mass at the given fee rate, and
+// which pays its change to changeAddress. Since adding inputs
+// increases the mass, the selection is repeated with the newly required fee
+// until the selected inputs cover both the amount and the fee.
+func generateTransactionWithFee(utxos []*appmessage.UTXOsByAddressesEntry, payments []*payment,
+	changeAddress util.Address, feeRate float64) (*externalapi.DomainTransaction, error) {
 
-	inputs := make([]*externalapi.DomainTransactionInput, len(selectedUTXOs))
-	for i, selectedUTXO := range selectedUTXOs {
-		outpointTransactionIDBytes, err := hex.DecodeString(selectedUTXO.Outpoint.TransactionID)
+	// Change that would be rejected as dust goes to the fee instead
+	changeDustThreshold, err := dustThreshold(changeAddress)
+	if err != nil {
+		return nil, err
+	}
+	sompisToSend := totalPaymentsAmount(payments)
+	fee := uint64(0)
+	for {
+		selectedUTXOs, changeSompi, err := utxoSelector.SelectUTXOs(utxos, sompisToSend+fee)
 		if err != nil {
 			return nil, err
 		}
-		outpointTransactionID, err := transactionid.FromBytes(outpointTransactionIDBytes)
+		if changeSompi < changeDustThreshold {
+			changeSompi = 0
+		}
+
+		domainTransaction, err := generateUnsignedTransaction(selectedUTXOs, payments, changeAddress, changeSompi)
 		if err != nil {
 			return nil, err
 		}
-		outpoint := externalapi.DomainOutpoint{
-			TransactionID: *outpointTransactionID,
-			Index:         selectedUTXO.Outpoint.Index,
+
+		mass := calculateTransactionMass(domainTransaction)
+		if mass > mempool.MaximumStandardTransactionMass {
+			return nil, errors.Errorf("Transaction mass %d exceeds the maximum standard transaction mass %d",
+				mass, mempool.MaximumStandardTransactionMass)
 		}
 
-		utxoEntry, err := utxoEntryToDomain(selectedUTXO)
-		if err != nil {
-			return nil, err
+		requiredFee := calculateFee(mass, feeRate)
+		if requiredFee <= fee {
+			return domainTransaction, nil
 		}
+		fee = requiredFee
+	}
+}
+
+// dustThreshold returns the smallest value of an output to the given
+// address that kaspad's mempool doesn't reject as dust under its default
+// minimum relay fee. Spending such an output costs no more than a third
+// of the minimum relay fee of the output and a typical input.
+func dustThreshold(address util.Address) (uint64, error) {
+	const typicalInputSerializedSize = 148
+	script, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		return 0, err
+	}
+	output := &externalapi.DomainTransactionOutput{ScriptPublicKey: script}
+	totalSerializedSize := txmass.TransactionOutputEstimatedSerializedSize(output) + typicalInputSerializedSize
+	minimumRelayTransactionFee := uint64(mempool.DefaultConfig(config.ActiveNetParams()).MinimumRelayTransactionFee)
+	return (3*totalSerializedSize*minimumRelayTransactionFee + 999) / 1000, nil
+}
 
-		inputs[i] = &externalapi.DomainTransactionInput{
-			PreviousOutpoint: outpoint,
-			SignatureScript:  nil,
-			Sequence:         0,
-			UTXOEntry:        utxoEntry,
+// recipientDustThreshold returns the highest dust threshold among the
+// types of addresses that payouts may be sent to, so that an amount
+// above it is never rejected as dust, whatever the recipient address is.
+func recipientDustThreshold() (uint64, error) {
+	prefix := config.ActiveNetParams().Prefix
+	schnorrAddress, err := util.NewAddressPublicKey(make([]byte, util.PublicKeySize), prefix)
+	if err != nil {
+		return 0, err
+	}
+	ecdsaAddress, err := util.NewAddressPublicKeyECDSA(make([]byte, util.PublicKeySizeECDSA), prefix)
+	if err != nil {
+		return 0, err
+	}
+	scriptHashAddress, err := util.NewAddressScriptHash(nil, prefix)
+	if err != nil {
+		return 0, err
+	}
+	highestThreshold := uint64(0)
+	for _, address := range []util.Address{schnorrAddress, ecdsaAddress, scriptHashAddress} {
+		threshold, err := dustThreshold(address)
+		if err != nil {
+			return 0, err
+		}
+		if threshold > highestThreshold {
+			highestThreshold = threshold
 		}
 	}
+	return highestThreshold, nil
+}
+
+func calculateTransactionMass(domainTransaction *externalapi.DomainTransaction) uint64 {
+	params := config.ActiveNetParams()
+	massCalculator := txmass.NewCalculator(params.MassPerTxByte, params.MassPerScriptPubKeyByte, params.MassPerSigOp)
+	return massCalculator.CalculateTransactionMass(domainTransaction)
+}
+
+// calculateFee returns the fee in sompi for a transaction of the given
+// mass, rounded up so that the fee rate is never underpaid.
+func calculateFee(mass uint64, feeRate float64) uint64 {
+	return uint64(math.Ceil(float64(mass) * feeRate))
+}
 
-	toScript, err := txscript.PayToAddrScript(toAddress)
+// fetchUTXOs fetches all the UTXOs of the faucet's addresses along with
+// the current virtual selected parent blue score and virtual DAA score.
+func fetchUTXOs(client *rpcclient.RPCClient) (
+	utxos []*appmessage.UTXOsByAddressesEntry, virtualSelectedParentBlueScore uint64, virtualDAAScore uint64, err error) {
+
+	getUTXOsByAddressesResponse, err := client.GetUTXOsByAddresses(faucetKeys.watchedAddresses())
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
-	mainOutput := &externalapi.DomainTransactionOutput{
-		Value:           sompisToSend,
-		ScriptPublicKey: toScript,
+	virtualSelectedParentBlueScoreResponse, err := client.GetVirtualSelectedParentBlueScore()
+	if err != nil {
+		return nil, 0, 0, err
 	}
-	fromScript, err := txscript.PayToAddrScript(faucetAddress)
+	blockDAGInfoResponse, err := client.GetBlockDAGInfo()
 	if err != nil {
-		return nil, err
+		return nil, 0, 0, err
 	}
-	changeOutput := &externalapi.DomainTransactionOutput{
-		Value:           change,
-		ScriptPublicKey: fromScript,
+	return getUTXOsByAddressesResponse.Entries, virtualSelectedParentBlueScoreResponse.BlueScore,
+		blockDAGInfoResponse.VirtualDAAScore, nil
+}
+
+// generateUnsignedTransaction builds a transaction that spends the
+// selected UTXOs, pays every payment in its own output and returns the
+// change to the given change address. It fills the signature scripts
+// with zeros of the size of real ones, so that the mass of the
+// transaction is already that of the signed transaction.
+func generateUnsignedTransaction(selectedUTXOs []*appmessage.UTXOsByAddressesEntry,
+	payments []*payment, changeAddress util.Address, change uint64) (*externalapi.DomainTransaction, error) {
+
+	inputs := make([]*externalapi.DomainTransactionInput, len(selectedUTXOs))
+	for i, selectedUTXO := range selectedUTXOs {
+		input, err := utxoToInput(selectedUTXO)
+		if err != nil {
+			return nil, err
+		}
+		input.SignatureScript = make([]byte, faucetKeys.signatureScriptSize)
+		inputs[i] = input
+	}
+
+	outputs := make([]*externalapi.DomainTransactionOutput, 0, len(payments)+1)
+	for _, payment := range payments {
+		toScript, err := txscript.PayToAddrScript(payment.address)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, &externalapi.DomainTransactionOutput{
+			Value:           payment.amount,
+			ScriptPublicKey: toScript,
+		})
+	}
+	if change > 0 {
+		changeScript, err := txscript.PayToAddrScript(changeAddress)
+		if err != nil {
+			return nil, err
+		}
+		changeOutput := &externalapi.DomainTransactionOutput{
+			Value:           change,
+			ScriptPublicKey: changeScript,
+		}
+		outputs = append(outputs, changeOutput)
 	}
-	outputs := []*externalapi.DomainTransactionOutput{mainOutput, changeOutput}
 
 	domainTransaction := &externalapi.DomainTransaction{
 		Version:      constants.MaxTransactionVersion,
@@ -165,18 +377,78 @@ func generateTransaction(selectedUTXOs []*appmessage.UTXOsByAddressesEntry,
 		Payload:      nil,
 	}
 
-	sighashReusedValues := &consensushashing.SighashReusedValues{}
+	return domainTransaction, nil
+}
+
+// signTransaction has the faucet's signers sign every input of the given
+// transaction with the key of the address of the UTXO it spends. The
+// inputs of a multisig faucet are signed by all of its signers, and the
+// signatures are followed by the redeem script.
+func signTransaction(domainTransaction *externalapi.DomainTransaction) error {
+	inputs := make([]*signer.Input, len(domainTransaction.Inputs))
 	for i, input := range domainTransaction.Inputs {
-		signatureScript, err := txscript.SignatureScript(
-			domainTransaction, i, consensushashing.SigHashAll, faucetPrivateKey, sighashReusedValues)
+		address, ok := faucetKeys.ownAddress(input.UTXOEntry.ScriptPublicKey())
+		if !ok {
+			return errors.Errorf("input %d doesn't spend a UTXO of the faucet", i)
+		}
+		derivationPath, err := faucetKeys.derivationPath(address)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		inputs[i] = &signer.Input{Index: i, DerivationPath: derivationPath}
+	}
+	signatures := make([][][]byte, len(faucetSigners))
+	for i, faucetSigner := range faucetSigners {
+		var err error
+		signatures[i], err = faucetSigner.Sign(domainTransaction, inputs)
+		if err != nil {
+			return errors.Wrap(err, "failed to sign the transaction")
+		}
+	}
+	for i, input := range domainTransaction.Inputs {
+		scriptBuilder := txscript.NewScriptBuilder()
+		for _, signerSignatures := range signatures {
+			scriptBuilder.AddData(signerSignatures[i])
+		}
+		if faucetKeys.redeemScript != nil {
+			scriptBuilder.AddData(faucetKeys.redeemScript)
+		}
+		signatureScript, err := scriptBuilder.Script()
+		if err != nil {
+			return err
 		}
 		input.SignatureScript = signatureScript
 	}
+	return nil
+}
 
-	rpcTransaction := appmessage.DomainTransactionToRPCTransaction(domainTransaction)
-	return rpcTransaction, nil
+// utxoToInput returns an unsigned transaction input that spends the given UTXO.
+func utxoToInput(selectedUTXO *appmessage.UTXOsByAddressesEntry) (*externalapi.DomainTransactionInput, error) {
+	outpointTransactionIDBytes, err := hex.DecodeString(selectedUTXO.Outpoint.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	outpointTransactionID, err := transactionid.FromBytes(outpointTransactionIDBytes)
+	if err != nil {
+		return nil, err
+	}
+	outpoint := externalapi.DomainOutpoint{
+		TransactionID: *outpointTransactionID,
+		Index:         selectedUTXO.Outpoint.Index,
+	}
+
+	utxoEntry, err := utxoEntryToDomain(selectedUTXO)
+	if err != nil {
+		return nil, err
+	}
+
+	return &externalapi.DomainTransactionInput{
+		PreviousOutpoint: outpoint,
+		SignatureScript:  nil,
+		Sequence:         0,
+		UTXOEntry:        utxoEntry,
+		SigOpCount:       faucetKeys.sigOpCount,
+	}, nil
 }
 
 func utxoEntryToDomain(selectedUTXO *appmessage.UTXOsByAddressesEntry) (externalapi.UTXOEntry, error) {
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,6 +17,10 @@ type HandlerError struct {
 	Code          int
 	Cause         error
 	ClientMessage string
+
+	// RetryAfter, if set, is sent to the client in the
+	// Retry-After header and in the retryAfter field.
+	RetryAfter time.Duration
 }
 
 func (hErr *HandlerError) Error() string {
@@ -40,6 +46,18 @@ func NewHandlerErrorWithCustomClientMessage(code int, err error, clientMessage s
 	}
 }
 
+// NewRateLimitHandlerError returns a http.StatusForbidden HandlerError
+// with the given message and client error message, that tells the client
+// to retry after the given duration.
+func NewRateLimitHandlerError(err error, clientMessage string, retryAfter time.Duration) error {
+	return &HandlerError{
+		Code:          http.StatusForbidden,
+		Cause:         err,
+		ClientMessage: clientMessage,
+		RetryAfter:    retryAfter,
+	}
+}
+
 // NewInternalServerHandlerError returns a HandlerError with
 // the given message, and the http.StatusInternalServerError
 // status text as client message.
@@ -63,6 +81,10 @@ func NewErrorFromDBErrors(prefix string, dbErrors []error) error {
 type ClientError struct {
 	ErrorCode    int    `json:"errorCode"`
 	ErrorMessage string `json:"errorMessage"`
+
+	// RetryAfter is the number of seconds after which the
+	// request may be retried.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
 }
 
 func (err *ClientError) Error() string {
@@ -77,11 +99,18 @@ func SendErr(ctx *ServerContext, w http.ResponseWriter, err error) {
 		hErr = NewInternalServerHandlerError(err).(*HandlerError)
 	}
 	ctx.Warnf("got error: %s", err)
-	w.WriteHeader(hErr.Code)
-	SendJSONResponse(w, &ClientError{
+	clientError := &ClientError{
 		ErrorCode:    hErr.Code,
 		ErrorMessage: hErr.ClientMessage,
-	})
+	}
+	if hErr.RetryAfter > 0 {
+		// Retry-After is in whole seconds, rounded up so that
+		// retrying right on time succeeds.
+		clientError.RetryAfter = int64((hErr.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(clientError.RetryAfter, 10))
+	}
+	w.WriteHeader(hErr.Code)
+	SendJSONResponse(w, clientError)
 }
 
 // SendJSONResponse encodes the given response to JSON format and
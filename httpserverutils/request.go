@@ -13,6 +13,14 @@ import (
 type HandlerFunc func(ctx *ServerContext, r *http.Request, routeParams map[string]string, queryParams map[string]string, requestBody []byte) (
 	interface{}, error)
 
+// ResponseWithStatusCode is a handler response that is sent
+// to the client with the given HTTP status code instead of
+// http.StatusOK.
+type ResponseWithStatusCode struct {
+	StatusCode int
+	Body       interface{}
+}
+
 // MakeHandler is a wrapper function that takes a handler in the form of HandlerFunc
 // and returns a function that can be used as a handler in mux.Router.HandleFunc.
 func MakeHandler(handler HandlerFunc) func(http.ResponseWriter, *http.Request) {
@@ -39,6 +47,10 @@ func MakeHandler(handler HandlerFunc) func(http.ResponseWriter, *http.Request) {
 			SendErr(ctx, w, err)
 			return
 		}
+		if responseWithStatusCode, ok := response.(*ResponseWithStatusCode); ok {
+			w.WriteHeader(responseWithStatusCode.StatusCode)
+			response = responseWithStatusCode.Body
+		}
 		if response != nil {
 			SendJSONResponse(w, response)
 		}
@@ -1,74 +1,283 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/go-pg/pg/v9"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/constants"
+
+	"github.com/kaspanet/faucet/config"
 	"github.com/kaspanet/faucet/database"
 	"github.com/kaspanet/faucet/httpserverutils"
 	"github.com/pkg/errors"
 )
 
-const minRequestInterval = time.Hour * 24
+// ipRequest is a payout request of an IP, as stored in
+// the ip_requests table.
+type ipRequest struct {
+	ID          int64
+	IP          string
+	RequestTime time.Time
+	Amount      uint64 `pg:",use_zero"`
+}
+
+// ipRequestsPruneInterval is the interval between prunes of the IP
+// requests that have left all rate limit windows.
+const ipRequestsPruneInterval = time.Hour
 
-type ipUse struct {
-	IP      string
-	LastUse time.Time
+// rateLimitWindow limits the requests of an IP within a sliding window,
+// either to a number of requests or to an amount.
+type rateLimitWindow struct {
+	window      time.Duration
+	maxRequests int
+	maxAmount   uint64
 }
 
-func ipFromRequest(r *http.Request) (string, error) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "", err
+// ipRateLimits are the windows that the requests of every IP are
+// limited by. A request must fit in all of them.
+var ipRateLimits []*rateLimitWindow
+
+func newRateLimitWindows(configWindows []*config.RateLimitWindow) ([]*rateLimitWindow, error) {
+	windows := make([]*rateLimitWindow, len(configWindows))
+	for i, configWindow := range configWindows {
+		maxAmount := uint64(0)
+		if configWindow.MaxAmount > 0 {
+			var err error
+			maxAmount, err = kaspaToSompi(configWindow.MaxAmount)
+			if err != nil {
+				return nil, err
+			}
+		}
+		windows[i] = &rateLimitWindow{
+			window:      configWindow.Window,
+			maxRequests: configWindow.MaxRequests,
+			maxAmount:   maxAmount,
+		}
+	}
+	return windows, nil
+}
+
+// retryAfter returns how long it takes until a request of the given
+// amount fits in the window, given the IP's previous requests sorted by
+// time, or 0 if it fits right away. It returns false if the request
+// can never fit.
+func (w *rateLimitWindow) retryAfter(requests []*ipRequest, amountSompi uint64, now time.Time) (time.Duration, bool) {
+	windowStart := now.Add(-w.window)
+	firstInWindow := len(requests)
+	windowAmount := uint64(0)
+	for i := len(requests) - 1; i >= 0 && requests[i].RequestTime.After(windowStart); i-- {
+		firstInWindow = i
+		windowAmount += requests[i].Amount
+	}
+	inWindow := requests[firstInWindow:]
+
+	// The request fits once enough of the oldest requests in the
+	// window leave it.
+	expiringCount := 0
+	if w.maxRequests > 0 && len(inWindow) >= w.maxRequests {
+		expiringCount = len(inWindow) - w.maxRequests + 1
+	}
+	if w.maxAmount > 0 {
+		if amountSompi > w.maxAmount {
+			return 0, false
+		}
+		remainingAmount := windowAmount
+		for _, expiringRequest := range inWindow[:expiringCount] {
+			remainingAmount -= expiringRequest.Amount
+		}
+		for remainingAmount+amountSompi > w.maxAmount {
+			remainingAmount -= inWindow[expiringCount].Amount
+			expiringCount++
+		}
+	}
+	if expiringCount == 0 {
+		return 0, true
+	}
+	lastExpiring := requests[firstInWindow+expiringCount-1]
+	return lastExpiring.RequestTime.Add(w.window).Sub(now), true
+}
+
+func (w *rateLimitWindow) String() string {
+	window := formatWindow(w.window)
+	if w.maxAmount > 0 {
+		return fmt.Sprintf("to receive %g KAS from the faucet every %s",
+			float64(w.maxAmount)/constants.SompiPerKaspa, window)
+	}
+	if w.maxRequests == 1 {
+		return fmt.Sprintf("to have one request from the faucet every %s", window)
+	}
+	return fmt.Sprintf("to have %d requests from the faucet every %s", w.maxRequests, window)
+}
+
+// formatWindow formats the given duration without its zero minutes and
+// seconds, such as 24h instead of 24h0m0s.
+func formatWindow(window time.Duration) string {
+	formatted := window.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+	if strings.HasSuffix(formatted, "h0m") {
+		formatted = strings.TrimSuffix(formatted, "0m")
+	}
+	return formatted
+}
+
+// longestRateLimitWindow returns the longest of ipRateLimits. Requests
+// older than it don't count towards any limit.
+func longestRateLimitWindow() time.Duration {
+	longestWindow := time.Duration(0)
+	for _, limit := range ipRateLimits {
+		if limit.window > longestWindow {
+			longestWindow = limit.window
+		}
 	}
-	return ip, nil
+	return longestWindow
 }
 
-func validateIPUsage(r *http.Request) error {
+// ipRequestsPruneLoop periodically prunes the IP requests that no longer
+// count towards any limit, so that the ip_requests table doesn't grow
+// without bound.
+func ipRequestsPruneLoop() {
+	for range time.Tick(ipRequestsPruneInterval) {
+		err := pruneIPRequests(time.Now())
+		if err != nil {
+			log.Errorf("Error pruning IP requests: %s", err)
+		}
+	}
+}
+
+// pruneIPRequests deletes the requests of all IPs that are older than
+// the longest rate limit window at the given time.
+func pruneIPRequests(now time.Time) error {
 	db, err := database.DB()
 	if err != nil {
 		return err
 	}
-	now := time.Now()
-	timeBeforeMinRequestInterval := now.Add(-minRequestInterval)
-	ip, err := ipFromRequest(r)
+	_, err = db.Model(&ipRequest{}).
+		Where("request_time <= ?", now.Add(-longestRateLimitWindow())).
+		Delete()
+	return err
+}
+
+// ipFromRequest returns the key that the rate limit of the client's IP
+// is kept under. IPs are bucketed into networks of the configured prefix
+// lengths, so that a user that holds a whole IPv6 network can't request
+// from each of its addresses.
+func ipFromRequest(r *http.Request) (string, error) {
+	cfg, err := config.MainConfig()
 	if err != nil {
-		return err
+		return "", err
 	}
-	count, err := db.Model(&ipUse{}).
-		Where("ip = ?", ip).
-		Where("last_use BETWEEN ? AND ?", timeBeforeMinRequestInterval, now).
-		Count()
-
+	ip, err := clientIP(r)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return ipRateLimitKey(ip, cfg.IPv4PrefixLength, cfg.IPv6PrefixLength), nil
+}
 
-	if count != 0 {
-		return httpserverutils.NewHandlerError(http.StatusForbidden, errors.New("A user is allowed to to have one request from the faucet every 24 hours"))
+// ipRateLimitKey returns the network of the given prefix length that the
+// given IP belongs to, such as 2001:db8::/64. IPv4-mapped IPv6 addresses
+// are treated as IPv4 addresses. An IP whose prefix length is its full
+// length is returned as is.
+func ipRateLimitKey(ip net.IP, ipv4PrefixLength int, ipv6PrefixLength int) string {
+	prefixLength, bits := ipv6PrefixLength, 8*net.IPv6len
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		prefixLength, bits = ipv4PrefixLength, 8*net.IPv4len
 	}
-	return nil
+	if prefixLength >= bits {
+		return ip.String()
+	}
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(prefixLength, bits)), Mask: net.CIDRMask(prefixLength, bits)}
+	return network.String()
+}
+
+// ipUsageClaim is the rate limit slot of an IP, claimed before paying
+// it. It's committed once the payout is sent, or rolled back if the
+// payout fails, which frees the slot again.
+type ipUsageClaim struct {
+	requestID int64
 }
 
-func updateIPUsage(r *http.Request) error {
+// claimIPUsage claims a rate limit slot of the given IP for a payout of
+// the given amount. It fails with http.StatusForbidden if the request
+// doesn't fit in any of the rate limit windows of the IP. The check and
+// the claim are made in a single transaction that holds a lock of the
+// IP, so that parallel requests from the same IP can't all pass the check.
+func claimIPUsage(ip string, amountSompi uint64) (*ipUsageClaim, error) {
 	db, err := database.DB()
 	if err != nil {
+		return nil, err
+	}
+	longestWindow := longestRateLimitWindow()
+	request := &ipRequest{IP: ip, RequestTime: time.Now(), Amount: amountSompi}
+	err = db.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", ip)
+		if err != nil {
+			return err
+		}
+		var requests []*ipRequest
+		err = tx.Model(&requests).
+			Where("ip = ?", ip).
+			Where("request_time > ?", request.RequestTime.Add(-longestWindow)).
+			Order("request_time").
+			Select()
+		if err != nil {
+			return err
+		}
+
+		retryAfter := time.Duration(0)
+		var exceededLimit *rateLimitWindow
+		for _, limit := range ipRateLimits {
+			limitRetryAfter, ok := limit.retryAfter(requests, amountSompi, request.RequestTime)
+			if !ok {
+				return httpserverutils.NewHandlerError(http.StatusForbidden,
+					errors.Errorf("A user is allowed %s", limit))
+			}
+			if limitRetryAfter > retryAfter {
+				retryAfter, exceededLimit = limitRetryAfter, limit
+			}
+		}
+		if exceededLimit != nil {
+			message := fmt.Sprintf("A user is allowed %s", exceededLimit)
+			return httpserverutils.NewRateLimitHandlerError(errors.New(message), message, retryAfter)
+		}
+
+		_, err = tx.Model(request).Insert()
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &ipUsageClaim{requestID: request.ID}, nil
+}
 
-	ip, err := ipFromRequest(r)
+// commit records the amount that was actually paid for the claim.
+func (c *ipUsageClaim) commit(amountSompi uint64) error {
+	db, err := database.DB()
 	if err != nil {
 		return err
 	}
+	_, err = db.Model(&ipRequest{}).
+		Set("amount = ?", amountSompi).
+		Where("id = ?", c.requestID).
+		Update()
+	return err
+}
 
-	ipUse := &ipUse{IP: ip, LastUse: time.Now()}
-	_, err = db.Model(ipUse).
-		OnConflict("(ip) DO UPDATE").
-		Insert()
-
+// rollback frees the claimed slot. It's also used when the payout
+// had eventually failed after it was committed.
+func (c *ipUsageClaim) rollback() error {
+	db, err := database.DB()
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = db.Model(&ipRequest{}).
+		Where("id = ?", c.requestID).
+		Delete()
+	return err
 }
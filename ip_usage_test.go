@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/pkg/errors"
+)
+
+// connectTestDatabase migrates and connects to the database that the
+// FAUCET_TEST_DB* environment variables point to, and skips the test
+// if FAUCET_TEST_DBNAME isn't set.
+func connectTestDatabase(t *testing.T) {
+	dbName := os.Getenv("FAUCET_TEST_DBNAME")
+	if dbName == "" {
+		t.Skip("FAUCET_TEST_DBNAME is not set")
+	}
+	dbAddress := os.Getenv("FAUCET_TEST_DBADDRESS")
+	if dbAddress == "" {
+		dbAddress = "localhost:5432"
+	}
+	cfg := &config.Config{
+		DBAddress:  dbAddress,
+		DBSSLMode:  "disable",
+		DBUser:     os.Getenv("FAUCET_TEST_DBUSER"),
+		DBPassword: os.Getenv("FAUCET_TEST_DBPASS"),
+		DBName:     dbName,
+	}
+	err := database.Migrate(cfg)
+	if err != nil {
+		t.Fatalf("Error migrating the database: %s", err)
+	}
+	err = database.Connect(cfg)
+	if err != nil {
+		t.Fatalf("Error connecting to the database: %s", err)
+	}
+	t.Cleanup(func() {
+		err := database.Close()
+		if err != nil {
+			t.Errorf("Error closing the database: %s", err)
+		}
+	})
+}
+
+// testIP returns an IP rate limit key that no other test run uses, and
+// deletes its requests once the test is done.
+func testIP(t *testing.T) string {
+	ip := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t.Cleanup(func() {
+		db, err := database.DB()
+		if err != nil {
+			return
+		}
+		_, err = db.Model(&ipRequest{}).Where("ip = ?", ip).Delete()
+		if err != nil {
+			t.Errorf("Error deleting the requests of %s: %s", ip, err)
+		}
+	})
+	return ip
+}
+
+func TestClaimIPUsageConcurrently(t *testing.T) {
+	connectTestDatabase(t)
+	ipRateLimits = []*rateLimitWindow{{window: 24 * time.Hour, maxRequests: 1}}
+	ip := testIP(t)
+
+	const parallelClaims = 20
+	claims := make([]*ipUsageClaim, parallelClaims)
+	claimErrors := make([]error, parallelClaims)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < parallelClaims; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			claims[i], claimErrors[i] = claimIPUsage(ip, 100_000_000)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var successfulClaim *ipUsageClaim
+	for i, err := range claimErrors {
+		if err == nil {
+			if successfulClaim != nil {
+				t.Fatalf("More than one parallel claim of %s succeeded", ip)
+			}
+			successfulClaim = claims[i]
+			continue
+		}
+		var handlerErr *httpserverutils.HandlerError
+		if !errors.As(err, &handlerErr) || handlerErr.Code != http.StatusForbidden {
+			t.Fatalf("Unexpected error claiming the usage of %s: %s", ip, err)
+		}
+	}
+	if successfulClaim == nil {
+		t.Fatalf("None of the parallel claims of %s succeeded", ip)
+	}
+
+	// Rolling the claim back frees the slot for the next request
+	err := successfulClaim.rollback()
+	if err != nil {
+		t.Fatalf("Error rolling back the claim: %s", err)
+	}
+	claim, err := claimIPUsage(ip, 100_000_000)
+	if err != nil {
+		t.Fatalf("Error claiming the usage of %s after rolling back: %s", ip, err)
+	}
+	err = claim.commit(100_000_000)
+	if err != nil {
+		t.Fatalf("Error committing the claim: %s", err)
+	}
+	_, err = claimIPUsage(ip, 100_000_000)
+	if err == nil {
+		t.Fatalf("Another claim of %s succeeded after the claim was committed", ip)
+	}
+}
+
+func TestPruneIPRequests(t *testing.T) {
+	connectTestDatabase(t)
+	ipRateLimits = []*rateLimitWindow{
+		{window: time.Hour, maxRequests: 3},
+		{window: 24 * time.Hour, maxRequests: 5},
+	}
+	ip := testIP(t)
+	db, err := database.DB()
+	if err != nil {
+		t.Fatalf("Error getting the database: %s", err)
+	}
+
+	now := time.Now()
+	for _, age := range []time.Duration{25 * time.Hour, 24 * time.Hour, 23 * time.Hour, time.Minute} {
+		_, err := db.Model(&ipRequest{IP: ip, RequestTime: now.Add(-age), Amount: 1}).Insert()
+		if err != nil {
+			t.Fatalf("Error inserting a request of %s: %s", ip, err)
+		}
+	}
+	err = pruneIPRequests(now)
+	if err != nil {
+		t.Fatalf("Error pruning IP requests: %s", err)
+	}
+
+	count, err := db.Model(&ipRequest{}).Where("ip = ?", ip).Count()
+	if err != nil {
+		t.Fatalf("Error counting the requests of %s: %s", ip, err)
+	}
+	if count != 2 {
+		t.Errorf("Expected the 2 requests within the longest window to be kept, got %d", count)
+	}
+}
+
+func TestRateLimitWindowRetryAfter(t *testing.T) {
+	now := time.Now()
+	requestsAged := func(amounts []uint64, ages ...time.Duration) []*ipRequest {
+		requests := make([]*ipRequest, len(ages))
+		for i, age := range ages {
+			requests[i] = &ipRequest{RequestTime: now.Add(-age), Amount: amounts[i]}
+		}
+		return requests
+	}
+
+	tests := []struct {
+		name               string
+		window             *rateLimitWindow
+		requests           []*ipRequest
+		amount             uint64
+		expectedRetryAfter time.Duration
+		expectedOK         bool
+	}{
+		{
+			name:       "no previous requests",
+			window:     &rateLimitWindow{window: time.Hour, maxRequests: 1},
+			amount:     1,
+			expectedOK: true,
+		},
+		{
+			name:       "request count below the limit",
+			window:     &rateLimitWindow{window: time.Hour, maxRequests: 3},
+			requests:   requestsAged([]uint64{1, 1}, 50*time.Minute, 10*time.Minute),
+			amount:     1,
+			expectedOK: true,
+		},
+		{
+			name:               "request count at the limit waits for the oldest request",
+			window:             &rateLimitWindow{window: time.Hour, maxRequests: 3},
+			requests:           requestsAged([]uint64{1, 1, 1}, 50*time.Minute, 40*time.Minute, 10*time.Minute),
+			amount:             1,
+			expectedRetryAfter: 10 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:               "request count above a lowered limit waits for enough requests",
+			window:             &rateLimitWindow{window: time.Hour, maxRequests: 1},
+			requests:           requestsAged([]uint64{1, 1, 1}, 50*time.Minute, 40*time.Minute, 10*time.Minute),
+			amount:             1,
+			expectedRetryAfter: 50 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:               "requests outside the window are ignored",
+			window:             &rateLimitWindow{window: time.Hour, maxRequests: 1},
+			requests:           requestsAged([]uint64{1, 1}, 2*time.Hour, 30*time.Minute),
+			amount:             1,
+			expectedRetryAfter: 30 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:       "a request exactly at the window start has expired",
+			window:     &rateLimitWindow{window: time.Hour, maxRequests: 1},
+			requests:   requestsAged([]uint64{1}, time.Hour),
+			amount:     1,
+			expectedOK: true,
+		},
+		{
+			name:       "amount that fills the quota exactly",
+			window:     &rateLimitWindow{window: time.Hour, maxAmount: 10},
+			requests:   requestsAged([]uint64{4, 4}, 50*time.Minute, 20*time.Minute),
+			amount:     2,
+			expectedOK: true,
+		},
+		{
+			name:               "amount over the quota waits for the oldest request",
+			window:             &rateLimitWindow{window: time.Hour, maxAmount: 10},
+			requests:           requestsAged([]uint64{4, 4}, 50*time.Minute, 20*time.Minute),
+			amount:             3,
+			expectedRetryAfter: 10 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:               "amount over the quota waits for every request",
+			window:             &rateLimitWindow{window: time.Hour, maxAmount: 10},
+			requests:           requestsAged([]uint64{4, 4}, 50*time.Minute, 20*time.Minute),
+			amount:             7,
+			expectedRetryAfter: 40 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:       "amount that can never fit",
+			window:     &rateLimitWindow{window: time.Hour, maxAmount: 10},
+			amount:     11,
+			expectedOK: false,
+		},
+		{
+			name:               "amount that fits once the request count does",
+			window:             &rateLimitWindow{window: time.Hour, maxRequests: 2, maxAmount: 10},
+			requests:           requestsAged([]uint64{1, 1, 8}, 50*time.Minute, 40*time.Minute, 10*time.Minute),
+			amount:             1,
+			expectedRetryAfter: 20 * time.Minute,
+			expectedOK:         true,
+		},
+		{
+			name:               "amount that needs more requests to expire than the request count",
+			window:             &rateLimitWindow{window: time.Hour, maxRequests: 2, maxAmount: 10},
+			requests:           requestsAged([]uint64{1, 1, 8}, 50*time.Minute, 40*time.Minute, 10*time.Minute),
+			amount:             5,
+			expectedRetryAfter: 50 * time.Minute,
+			expectedOK:         true,
+		},
+	}
+
+	for _, test := range tests {
+		retryAfter, ok := test.window.retryAfter(test.requests, test.amount, now)
+		if ok != test.expectedOK {
+			t.Errorf("%s: expected ok %t, got %t", test.name, test.expectedOK, ok)
+			continue
+		}
+		if retryAfter != test.expectedRetryAfter {
+			t.Errorf("%s: expected retry after %s, got %s", test.name, test.expectedRetryAfter, retryAfter)
+		}
+	}
+}
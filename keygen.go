@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/keystore"
+	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet/bip32"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+// keygenCommand is the subcommand that creates a new key file.
+const keygenCommand = "keygen"
+
+// runKeygen creates a key file holding a new HD key, and prints the
+// receive address the faucet will use with it, and its public key as
+// a multisig cosigner.
+func runKeygen(args []string) error {
+	keygenConfig, err := config.ParseKeygen(args)
+	if err != nil {
+		return err
+	}
+	password, err := keygenConfig.KeyfilePassword()
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("the key file password must not be empty")
+	}
+
+	extendedPublicKey, err := keystore.Create(keygenConfig.Keyfile, config.ActiveNetParams(), password, keygenConfig.Force)
+	if err != nil {
+		return err
+	}
+	receiveAddress, err := receiveAddressOf(extendedPublicKey)
+	if err != nil {
+		return err
+	}
+	multisigPublicKey, err := multisigPublicKeyOf(extendedPublicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created the key file %s\n", keygenConfig.Keyfile)
+	fmt.Printf("Extended public key: %s\n", extendedPublicKey)
+	fmt.Printf("Receive address: %s\n", receiveAddress)
+	fmt.Printf("Public key as a multisig cosigner: %s\n", multisigPublicKey)
+	return nil
+}
+
+// multisigPublicKeyOf returns the hex of the public key that the given
+// extended public account key has as a multisig cosigner.
+func multisigPublicKeyOf(extendedPublicKey string) (string, error) {
+	accountKey, err := bip32.DeserializeExtendedKey(extendedPublicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to deserialize the extended public key")
+	}
+	publicKey, err := derivePublicKey(accountKey, multisigCosignerPath)
+	if err != nil {
+		return "", err
+	}
+	serializedPublicKey, err := publicKey.Serialize()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(serializedPublicKey[:]), nil
+}
+
+// receiveAddressOf returns the address at m/0/0 of the given extended
+// public account key, which is the receive address of an HD keyring.
+func receiveAddressOf(extendedPublicKey string) (util.Address, error) {
+	accountKey, err := bip32.DeserializeExtendedKey(extendedPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return deriveP2PKHAddress(accountKey, fmt.Sprintf("m/%d/%d", externalKeychain, 0))
+}
+
+// loadKeyfile decrypts the given key file, and returns the extended
+// private account key it holds.
+func loadKeyfile(keyfileFlags *config.KeyfileFlags) (*bip32.ExtendedKey, error) {
+	keyFile, err := keystore.Read(keyfileFlags.Keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyFile.EncryptedKeys) != 1 || keyFile.MinimumSignatures > 1 {
+		return nil, errors.New("multisig key files are not supported")
+	}
+	password, err := keyfileFlags.KeyfilePassword()
+	if err != nil {
+		return nil, err
+	}
+	accountKeys, err := keyFile.AccountKeys(config.ActiveNetParams(), password)
+	if err != nil {
+		return nil, err
+	}
+	return accountKeys[0], nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/faucet/signer"
+	"github.com/kaspanet/go-secp256k1"
+	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet/bip32"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// The keychains of kaspawallet. Addresses are derived from the
+	// account key at m/<keychain>/<index>.
+	externalKeychain = 0
+	internalKeychain = 1
+
+	// changeAddressLookahead is how many change addresses are derived
+	// and watched ahead of the next unused one.
+	changeAddressLookahead = 100
+
+	// changeAddressRetirementDelay is how long a used change address is
+	// watched at least, whether or not it holds any UTXOs. It covers the
+	// time from building a transaction that pays it until the
+	// transaction is tracked.
+	changeAddressRetirementDelay = 10 * time.Minute
+
+	// p2pkSignatureScriptSize is the size of the signature script of a
+	// Schnorr P2PK input: OP_DATA_65, a 64 byte signature and a
+	// sighash type byte.
+	p2pkSignatureScriptSize = 66
+
+	// signatureSize is the size of a Schnorr signature with its
+	// sighash type byte.
+	signatureSize = 65
+)
+
+// keyring holds the faucet's addresses, and the derivation paths of the
+// keys that sign for them. It holds no private keys; those are kept by
+// the faucet's signers. It either holds a single public key whose address
+// receives both funds and change, an HD extended public account key
+// from which, like kaspawallet does, the receive address is derived at
+// m/0/0 and a fresh change address is derived at m/1/<index> for every
+// transaction that pays change, or the public keys of an m-of-n multisig whose P2SH
+// address receives both funds and change.
+type keyring struct {
+	lock sync.Mutex
+
+	// signatureScriptSize and sigOpCount are those of every input
+	// that spends one of the keyring's UTXOs.
+	signatureScriptSize int
+	sigOpCount          byte
+
+	// derivationPaths maps the faucet's addresses to the derivation paths
+	// of their keys relative to the account key. The paths are empty for
+	// single-key keyrings.
+	derivationPaths map[string]string
+
+	// The following fields are only set for HD keyrings. changeAddresses
+	// are the change addresses from firstChangeIndex on. The ones below
+	// it were retired, and so were those of them that are missing from
+	// derivationPaths.
+	accountKey              *bip32.ExtendedKey
+	extendedPublicKey       string
+	changeAddresses         []util.Address
+	firstChangeIndex        uint32
+	nextChangeIndex         uint32
+	changeAddressUseTimes   map[string]time.Time
+	onWatchedAddressesAdded func()
+
+	// The following fields are only set for multisig keyrings.
+	redeemScript       []byte
+	cosignerPublicKeys []string
+}
+
+var faucetKeys *keyring
+
+// newKeyring returns a keyring of the given signer account, and its
+// receive address. onWatchedAddressesAdded is called whenever more
+// change addresses of an HD account need to be watched.
+func newKeyring(account *signer.Account, onWatchedAddressesAdded func()) (*keyring, util.Address, error) {
+	if account.ExtendedPublicKey != "" {
+		return newHDKeyring(account.ExtendedPublicKey, onWatchedAddressesAdded)
+	}
+	return newSingleKeyring(account.PublicKey)
+}
+
+// newSingleKeyring returns a keyring of the given hex-encoded
+// Schnorr public key.
+func newSingleKeyring(publicKeyHex string) (*keyring, util.Address, error) {
+	serializedPublicKey, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "malformed public key")
+	}
+	publicKey, err := secp256k1.DeserializeSchnorrPubKey(serializedPublicKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "malformed public key")
+	}
+	address, err := publicKeyToP2PKHAddress(publicKey, config.ActiveNetParams())
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := &keyring{
+		signatureScriptSize: p2pkSignatureScriptSize,
+		sigOpCount:          1,
+		derivationPaths:     map[string]string{address.EncodeAddress(): ""},
+	}
+	return keys, address, nil
+}
+
+// newHDKeyring returns a keyring of the given extended public account
+// key, and its receive address.
+func newHDKeyring(extendedPublicKey string, onWatchedAddressesAdded func()) (*keyring, util.Address, error) {
+	accountKey, err := bip32.DeserializeExtendedKey(extendedPublicKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to deserialize the extended public key")
+	}
+	if accountKey.IsPrivate() {
+		return nil, nil, errors.New("the extended key is not a public key")
+	}
+
+	storedWallet, err := loadHDWallet(extendedPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := &keyring{
+		signatureScriptSize:     p2pkSignatureScriptSize,
+		sigOpCount:              1,
+		derivationPaths:         make(map[string]string),
+		accountKey:              accountKey,
+		extendedPublicKey:       extendedPublicKey,
+		firstChangeIndex:        storedWallet.FirstWatchedChangeIndex,
+		nextChangeIndex:         storedWallet.NextChangeIndex,
+		changeAddressUseTimes:   make(map[string]time.Time),
+		onWatchedAddressesAdded: onWatchedAddressesAdded,
+	}
+	receiveAddress, err := keys.deriveAddress(externalKeychain, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = keys.deriveChangeAddresses(keys.nextChangeIndex + changeAddressLookahead)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, receiveAddress, nil
+}
+
+// newMultisigKeyring returns a keyring of an m-of-n multisig of the given
+// hex-encoded Schnorr public keys, and its P2SH address. Like kaspawallet
+// does, the public keys are sorted, so that the address doesn't depend on
+// their order.
+func newMultisigKeyring(publicKeysHex []string, minimumSignatures uint32) (*keyring, util.Address, error) {
+	if len(publicKeysHex) > txscript.MaxPubKeysPerMultiSig {
+		return nil, nil, errors.Errorf("a multisig can't have more than %d public keys", txscript.MaxPubKeysPerMultiSig)
+	}
+	if minimumSignatures == 0 || minimumSignatures > uint32(len(publicKeysHex)) {
+		return nil, nil, errors.Errorf("the minimum number of signatures must be between 1 and %d", len(publicKeysHex))
+	}
+
+	cosignerPublicKeys := make([]string, len(publicKeysHex))
+	for i, publicKeyHex := range publicKeysHex {
+		serializedPublicKey, err := hex.DecodeString(publicKeyHex)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "malformed public key %s", publicKeyHex)
+		}
+		_, err = secp256k1.DeserializeSchnorrPubKey(serializedPublicKey)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "malformed public key %s", publicKeyHex)
+		}
+		cosignerPublicKeys[i] = hex.EncodeToString(serializedPublicKey)
+	}
+	sort.Strings(cosignerPublicKeys)
+	for i := 1; i < len(cosignerPublicKeys); i++ {
+		if cosignerPublicKeys[i] == cosignerPublicKeys[i-1] {
+			return nil, nil, errors.Errorf("the public key %s appears more than once", cosignerPublicKeys[i])
+		}
+	}
+
+	scriptBuilder := txscript.NewScriptBuilder()
+	scriptBuilder.AddInt64(int64(minimumSignatures))
+	for _, publicKey := range cosignerPublicKeys {
+		serializedPublicKey, _ := hex.DecodeString(publicKey)
+		scriptBuilder.AddData(serializedPublicKey)
+	}
+	scriptBuilder.AddInt64(int64(len(cosignerPublicKeys)))
+	scriptBuilder.AddOp(txscript.OpCheckMultiSig)
+	redeemScript, err := scriptBuilder.Script()
+	if err != nil {
+		return nil, nil, err
+	}
+	address, err := util.NewAddressScriptHash(redeemScript, config.ActiveNetParams().Prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The signature script pushes minimumSignatures signatures
+	// followed by the redeem script.
+	signatureScriptBuilder := txscript.NewScriptBuilder()
+	for i := uint32(0); i < minimumSignatures; i++ {
+		signatureScriptBuilder.AddData(make([]byte, signatureSize))
+	}
+	signatureScriptBuilder.AddData(redeemScript)
+	signatureScript, err := signatureScriptBuilder.Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := &keyring{
+		signatureScriptSize: len(signatureScript),
+		sigOpCount:          byte(len(cosignerPublicKeys)),
+		derivationPaths:     map[string]string{address.EncodeAddress(): ""},
+		redeemScript:        redeemScript,
+		cosignerPublicKeys:  cosignerPublicKeys,
+	}
+	return keys, address, nil
+}
+
+// cosignerIndex returns the index of the given hex-encoded public key
+// in the redeem script of a multisig keyring, and whether it's there.
+func (k *keyring) cosignerIndex(publicKeyHex string) (int, bool) {
+	for i, publicKey := range k.cosignerPublicKeys {
+		if publicKey == publicKeyHex {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// deriveAddress derives the address at m/<keychain>/<index>, adds it to
+// the keyring and returns it. It must be called with the lock held.
+func (k *keyring) deriveAddress(keychain uint32, index uint32) (util.Address, error) {
+	derivationPath := fmt.Sprintf("m/%d/%d", keychain, index)
+	address, err := deriveP2PKHAddress(k.accountKey, derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	k.derivationPaths[address.EncodeAddress()] = derivationPath
+	return address, nil
+}
+
+// deriveP2PKHAddress returns the address of the key derived from the
+// given extended key at the given path.
+func deriveP2PKHAddress(extendedKey *bip32.ExtendedKey, derivationPath string) (util.Address, error) {
+	publicKey, err := derivePublicKey(extendedKey, derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyToP2PKHAddress(publicKey, config.ActiveNetParams())
+}
+
+// derivePublicKey returns the Schnorr public key derived from the
+// given extended key at the given path.
+func derivePublicKey(extendedKey *bip32.ExtendedKey, derivationPath string) (*secp256k1.SchnorrPublicKey, error) {
+	derivedKey, err := extendedKey.DeriveFromPath(derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPublicKey, err := derivedKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return ecdsaPublicKey.ToSchnorr()
+}
+
+// deriveChangeAddresses derives change addresses up to the given
+// index. It must be called with the lock held.
+func (k *keyring) deriveChangeAddresses(toIndex uint32) error {
+	for index := k.firstChangeIndex + uint32(len(k.changeAddresses)); index < toIndex; index++ {
+		address, err := k.deriveAddress(internalKeychain, index)
+		if err != nil {
+			return err
+		}
+		k.changeAddresses = append(k.changeAddresses, address)
+	}
+	return nil
+}
+
+// changeAddress returns the address that the change of the next
+// transaction should be paid to. HD keyrings return the same fresh
+// address until it's used up by useChangeAddress.
+func (k *keyring) changeAddress() util.Address {
+	if k.accountKey == nil {
+		return faucetAddress
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.changeAddresses[k.nextChangeIndex-k.firstChangeIndex]
+}
+
+// useChangeAddress marks the given address, returned by changeAddress,
+// as used, so that HD keyrings return a fresh address from now on.
+func (k *keyring) useChangeAddress(address util.Address) error {
+	if k.accountKey == nil {
+		return nil
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if address.EncodeAddress() != k.changeAddresses[k.nextChangeIndex-k.firstChangeIndex].EncodeAddress() {
+		return nil
+	}
+	err := storeNextChangeIndex(k.extendedPublicKey, k.nextChangeIndex+1)
+	if err != nil {
+		return err
+	}
+	k.nextChangeIndex++
+	k.changeAddressUseTimes[address.EncodeAddress()] = time.Now()
+
+	// Watch more addresses once half of the lookahead is used up
+	if k.nextChangeIndex+changeAddressLookahead/2 > k.firstChangeIndex+uint32(len(k.changeAddresses)) {
+		err := k.deriveChangeAddresses(k.nextChangeIndex + changeAddressLookahead)
+		if err != nil {
+			return err
+		}
+		spawn("keyring-onWatchedAddressesAdded", k.onWatchedAddressesAdded)
+	}
+	return nil
+}
+
+// retireChangeAddresses stops watching the used change addresses of an
+// HD keyring that aren't in the given set of addresses in use, and that
+// weren't used within changeAddressRetirementDelay. Without retirement,
+// every payout that pays change would add an address to watch for good.
+// The lowest change index that's still watched is stored, so that the
+// retired addresses below it aren't watched again after a restart.
+func (k *keyring) retireChangeAddresses(addressesInUse map[string]struct{}) error {
+	if k.accountKey == nil {
+		return nil
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	now := time.Now()
+	firstWatchedIndex := k.nextChangeIndex
+	for index := k.firstChangeIndex; index < k.nextChangeIndex; index++ {
+		address := k.changeAddresses[index-k.firstChangeIndex].EncodeAddress()
+		if _, ok := k.derivationPaths[address]; !ok {
+			continue
+		}
+		_, isInUse := addressesInUse[address]
+		if isInUse || now.Sub(k.changeAddressUseTimes[address]) < changeAddressRetirementDelay {
+			if index < firstWatchedIndex {
+				firstWatchedIndex = index
+			}
+			continue
+		}
+		delete(k.derivationPaths, address)
+		delete(k.changeAddressUseTimes, address)
+	}
+
+	if firstWatchedIndex > k.firstChangeIndex {
+		err := storeFirstWatchedChangeIndex(k.extendedPublicKey, firstWatchedIndex)
+		if err != nil {
+			return err
+		}
+		k.changeAddresses = k.changeAddresses[firstWatchedIndex-k.firstChangeIndex:]
+		k.firstChangeIndex = firstWatchedIndex
+	}
+	return nil
+}
+
+// watchedAddresses returns the addresses whose UTXOs belong to the faucet.
+func (k *keyring) watchedAddresses() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	addresses := make([]string, 0, len(k.derivationPaths))
+	for address := range k.derivationPaths {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// derivationPath returns the derivation path of the key that signs
+// for the given address.
+func (k *keyring) derivationPath(address string) (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	derivationPath, ok := k.derivationPaths[address]
+	if !ok {
+		return "", errors.Errorf("no key for address %s", address)
+	}
+	return derivationPath, nil
+}
+
+// ownAddress returns the address of the given script public key,
+// and whether it's one of the faucet's addresses.
+func (k *keyring) ownAddress(scriptPublicKey *externalapi.ScriptPublicKey) (string, bool) {
+	_, address, err := txscript.ExtractScriptPubKeyAddress(scriptPublicKey, config.ActiveNetParams())
+	if err != nil || address == nil {
+		return "", false
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	_, ok := k.derivationPaths[address.EncodeAddress()]
+	return address.EncodeAddress(), ok
+}
+
+// hdWallet is the derivation state of an HD keyring, as stored
+// in the hd_wallets table.
+type hdWallet struct {
+	ExtendedPublicKey       string `pg:",pk"`
+	NextChangeIndex         uint32 `pg:",use_zero"`
+	FirstWatchedChangeIndex uint32 `pg:",use_zero"`
+}
+
+// loadHDWallet returns the stored derivation state of the given
+// extended public key, which is all zeros if none is stored.
+func loadHDWallet(extendedPublicKey string) (*hdWallet, error) {
+	db, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	wallet := &hdWallet{ExtendedPublicKey: extendedPublicKey}
+	err = db.Model(wallet).WherePK().Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return &hdWallet{ExtendedPublicKey: extendedPublicKey}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+func storeNextChangeIndex(extendedPublicKey string, nextChangeIndex uint32) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&hdWallet{ExtendedPublicKey: extendedPublicKey, NextChangeIndex: nextChangeIndex}).
+		OnConflict("(extended_public_key) DO UPDATE").
+		Set("next_change_index = EXCLUDED.next_change_index").
+		Insert()
+	return err
+}
+
+func storeFirstWatchedChangeIndex(extendedPublicKey string, firstWatchedChangeIndex uint32) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&hdWallet{}).
+		Set("first_watched_change_index = ?", firstWatchedChangeIndex).
+		Where("extended_public_key = ?", extendedPublicKey).
+		Update()
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet/bip32"
+)
+
+func TestRetireChangeAddresses(t *testing.T) {
+	_, err := config.ParseKeygen([]string{"--keyfile=unused", "--testnet"})
+	if err != nil {
+		t.Fatalf("Error choosing the network: %s", err)
+	}
+	masterKey, err := bip32.NewMaster(make([]byte, 32), bip32.KaspaTestnetPrivate)
+	if err != nil {
+		t.Fatalf("Error creating a master key: %s", err)
+	}
+	accountKey, err := masterKey.Public()
+	if err != nil {
+		t.Fatalf("Error getting the public key: %s", err)
+	}
+
+	// Change addresses 0 to 3 are used and 4 to 5 are watched ahead
+	keys := &keyring{
+		derivationPaths:       make(map[string]string),
+		accountKey:            accountKey,
+		nextChangeIndex:       4,
+		changeAddressUseTimes: make(map[string]time.Time),
+	}
+	err = keys.deriveChangeAddresses(6)
+	if err != nil {
+		t.Fatalf("Error deriving change addresses: %s", err)
+	}
+	changeAddresses := make([]string, len(keys.changeAddresses))
+	for i, address := range keys.changeAddresses {
+		changeAddresses[i] = address.EncodeAddress()
+	}
+	keys.changeAddressUseTimes[changeAddresses[2]] = time.Now().Add(-2 * changeAddressRetirementDelay)
+	keys.changeAddressUseTimes[changeAddresses[3]] = time.Now()
+
+	// Address 0 holds funds, so the stored watermark doesn't move
+	// and the test doesn't need a database
+	err = keys.retireChangeAddresses(map[string]struct{}{changeAddresses[0]: {}})
+	if err != nil {
+		t.Fatalf("Error retiring change addresses: %s", err)
+	}
+
+	expectedWatched := map[int]bool{0: true, 1: false, 2: false, 3: true, 4: true, 5: true}
+	for index, isWatched := range expectedWatched {
+		_, ok := keys.derivationPaths[changeAddresses[index]]
+		if ok != isWatched {
+			t.Errorf("change address %d: expected watched %t, got %t", index, isWatched, ok)
+		}
+	}
+	if keys.firstChangeIndex != 0 {
+		t.Errorf("expected the first change index to stay 0, got %d", keys.firstChangeIndex)
+	}
+	if keys.changeAddress().EncodeAddress() != changeAddresses[4] {
+		t.Errorf("expected the next change address to stay %s, got %s", changeAddresses[4], keys.changeAddress())
+	}
+}
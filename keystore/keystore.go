@@ -0,0 +1,264 @@
+// Package keystore reads and writes password-encrypted key files in the
+// layout of kaspawallet's keys.json.
+package keystore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet/bip32"
+	"github.com/kaspanet/kaspad/domain/dagconfig"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AccountPath is the derivation path of the account key that
+// kaspawallet derives its addresses from.
+const AccountPath = "m/44'/111111'/0'"
+
+const (
+	lastVersion = 1
+
+	// defaultNumThreads is the argon2 parallelism of version 1 files.
+	defaultNumThreads = 8
+)
+
+type encryptedKeyJSON struct {
+	Cipher string `json:"cipher"`
+	Salt   string `json:"salt"`
+}
+
+// File is a key file. Its fields match kaspawallet's keys.json, so files
+// created by kaspawallet can be read as is. The encrypted keys are either
+// BIP39 mnemonics, as kaspawallet creates, or extended private keys, as
+// keygen creates.
+type File struct {
+	Version               uint32              `json:"version"`
+	NumThreads            uint8               `json:"numThreads,omitempty"`
+	EncryptedKeys         []*encryptedKeyJSON `json:"encryptedMnemonics"`
+	ExtendedPublicKeys    []string            `json:"publicKeys"`
+	MinimumSignatures     uint32              `json:"minimumSignatures"`
+	CosignerIndex         uint32              `json:"cosignerIndex"`
+	LastUsedExternalIndex uint32              `json:"lastUsedExternalIndex"`
+	LastUsedInternalIndex uint32              `json:"lastUsedInternalIndex"`
+	ECDSA                 bool                `json:"ecdsa"`
+}
+
+// Read reads the key file at the given path.
+func Read(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	keyFile := &File{}
+	err = decoder.Decode(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "malformed key file %s", path)
+	}
+	return keyFile, nil
+}
+
+// AccountKeys decrypts the file's keys with the given password, and
+// returns their extended private keys at AccountPath.
+func (f *File) AccountKeys(params *dagconfig.Params, password string) ([]*bip32.ExtendedKey, error) {
+	if f.ECDSA {
+		return nil, errors.New("ECDSA key files are not supported")
+	}
+	numThreads := uint8(defaultNumThreads)
+	if f.Version == 0 {
+		// Version 0 files were encrypted with as many threads as the
+		// machine that created them had CPUs, which kaspawallet records
+		// once it figures it out.
+		if f.NumThreads == 0 {
+			return nil, errors.New("the key file is of version 0 and doesn't record its number of threads. " +
+				"Open it with kaspawallet once to upgrade it")
+		}
+		numThreads = f.NumThreads
+	}
+
+	accountKeys := make([]*bip32.ExtendedKey, len(f.EncryptedKeys))
+	for i, encryptedKey := range f.EncryptedKeys {
+		decryptedKey, err := decrypt(encryptedKey, numThreads, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+		accountKeys[i], err = accountKey(params, decryptedKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return accountKeys, nil
+}
+
+// accountKey returns the account key of the given decrypted key, which
+// is either a mnemonic or an extended private key.
+func accountKey(params *dagconfig.Params, decryptedKey string) (*bip32.ExtendedKey, error) {
+	if len(strings.Fields(decryptedKey)) == 1 {
+		return ParseAccountKey(decryptedKey)
+	}
+
+	version, err := privateKeyVersion(params)
+	if err != nil {
+		return nil, err
+	}
+	// The BIP39 seed of a mnemonic without a passphrase
+	seed := pbkdf2.Key([]byte(decryptedKey), []byte("mnemonic"), 2048, 64, sha512.New)
+	return bip32.NewMasterWithPath(seed, version, AccountPath)
+}
+
+// ParseAccountKey parses the given extended private key. A master key
+// is derived to AccountPath; any other key is assumed to be an account
+// key already.
+func ParseAccountKey(extendedPrivateKey string) (*bip32.ExtendedKey, error) {
+	extendedKey, err := bip32.DeserializeExtendedKey(extendedPrivateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed extended private key")
+	}
+	if !extendedKey.IsPrivate() {
+		return nil, errors.New("the extended key is not a private key")
+	}
+	if extendedKey.Depth == 0 {
+		return extendedKey.DeriveFromPath(AccountPath)
+	}
+	return extendedKey, nil
+}
+
+// Create creates a key file at the given path holding a new random
+// extended private key, encrypted with the given password. It returns
+// the extended public key of the account.
+func Create(path string, params *dagconfig.Params, password string, overwrite bool) (string, error) {
+	if !overwrite {
+		_, err := os.Stat(path)
+		if err == nil {
+			return "", errors.Errorf("the file %s already exists", path)
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	version, err := privateKeyVersion(params)
+	if err != nil {
+		return "", err
+	}
+	seed, err := bip32.GenerateSeed()
+	if err != nil {
+		return "", err
+	}
+	masterKey, err := bip32.NewMaster(seed, version)
+	if err != nil {
+		return "", err
+	}
+	accountKey, err := masterKey.DeriveFromPath(AccountPath)
+	if err != nil {
+		return "", err
+	}
+	extendedPublicKey, err := accountKey.Public()
+	if err != nil {
+		return "", err
+	}
+	encryptedKey, err := encrypt(masterKey.String(), []byte(password))
+	if err != nil {
+		return "", err
+	}
+
+	keyFile := &File{
+		Version:            lastVersion,
+		NumThreads:         defaultNumThreads,
+		EncryptedKeys:      []*encryptedKeyJSON{encryptedKey},
+		ExtendedPublicKeys: []string{extendedPublicKey.String()},
+		MinimumSignatures:  1,
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	err = json.NewEncoder(file).Encode(keyFile)
+	if err != nil {
+		return "", err
+	}
+	return extendedPublicKey.String(), nil
+}
+
+func privateKeyVersion(params *dagconfig.Params) ([4]byte, error) {
+	switch params.Name {
+	case dagconfig.MainnetParams.Name:
+		return bip32.KaspaMainnetPrivate, nil
+	case dagconfig.TestnetParams.Name:
+		return bip32.KaspaTestnetPrivate, nil
+	case dagconfig.DevnetParams.Name:
+		return bip32.KaspaDevnetPrivate, nil
+	case dagconfig.SimnetParams.Name:
+		return bip32.KaspaSimnetPrivate, nil
+	}
+	return [4]byte{}, errors.Errorf("unknown network %s", params.Name)
+}
+
+func newAEAD(password []byte, salt []byte, numThreads uint8) (cipher.AEAD, error) {
+	key := argon2.IDKey(password, salt, 1, 64*1024, numThreads, 32)
+	return chacha20poly1305.NewX(key)
+}
+
+func encrypt(key string, password []byte) (*encryptedKeyJSON, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(password, salt, defaultNumThreads)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	// The ciphertext is appended to the nonce
+	ciphertext := aead.Seal(nonce, nonce, []byte(key), nil)
+	return &encryptedKeyJSON{
+		Cipher: hex.EncodeToString(ciphertext),
+		Salt:   hex.EncodeToString(salt),
+	}, nil
+}
+
+func decrypt(encryptedKey *encryptedKeyJSON, numThreads uint8, password []byte) (string, error) {
+	ciphertext, err := hex.DecodeString(encryptedKey.Cipher)
+	if err != nil {
+		return "", err
+	}
+	salt, err := hex.DecodeString(encryptedKey.Salt)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(password, salt, numThreads)
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return "", errors.New("the encrypted key is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	decrypted, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt the key file. Is the password correct?")
+	}
+	return string(decrypted), nil
+}
@@ -4,11 +4,15 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/kaspanet/faucet/config"
 	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/faucet/keystore"
+	"github.com/kaspanet/faucet/signer"
 	"github.com/kaspanet/faucet/version"
 	"github.com/kaspanet/go-secp256k1"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
 	"github.com/kaspanet/kaspad/domain/dagconfig"
 	"github.com/kaspanet/kaspad/util"
 	"github.com/kaspanet/kaspad/util/profiling"
@@ -20,15 +24,34 @@ import (
 	"github.com/kaspanet/kaspad/util/panics"
 )
 
-var (
-	faucetAddress    util.Address
-	faucetPrivateKey *secp256k1.SchnorrKeyPair
-)
+// faucetAddress is the address that receives the faucet's funds.
+var faucetAddress util.Address
+
+// faucetSigners sign the faucet's transactions. A multisig faucet has
+// one for each cosigner that signs, ordered like their public keys in
+// the redeem script.
+var faucetSigners []signer.Signer
 
 func main() {
 	defer panics.HandlePanic(log, "main", nil)
 	interrupt := signal.InterruptListener()
 
+	if len(os.Args) > 1 && (os.Args[1] == keygenCommand || os.Args[1] == signerCommand) {
+		run := runKeygen
+		if os.Args[1] == signerCommand {
+			run = runSigner
+		}
+		err := run(os.Args[2:])
+		if err != nil {
+			_, err = fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			if err != nil {
+				panic(err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := config.Parse()
 	if err != nil {
 		err := errors.Wrap(err, "Error parsing command-line arguments")
@@ -71,30 +94,264 @@ func main() {
 		}
 	}()
 
-	privateKeyBytes, err := hex.DecodeString(cfg.PrivateKey)
+	if len(cfg.MultisigPublicKeys) > 0 {
+		faucetKeys, faucetAddress, err = newMultisigKeyring(cfg.MultisigPublicKeys, cfg.MultisigMinimumSignatures)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create the multisig keyring"))
+		}
+		faucetSigners, err = newMultisigSigners(faucetKeys, cfg)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create the multisig signers"))
+		}
+	} else {
+		faucetSigner, err := newSigner(cfg)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create the signer"))
+		}
+		account, err := faucetSigner.Account()
+		if err != nil {
+			panic(errors.Wrap(err, "failed to get the signer's account"))
+		}
+		faucetKeys, faucetAddress, err = newKeyring(account, handleWatchedAddressesAdded)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create the keyring"))
+		}
+		faucetSigners = []signer.Signer{faucetSigner}
+	}
+
+	ipRateLimits, err = newRateLimitWindows(cfg.IPRateLimitWindows)
+	if err != nil {
+		panic(errors.Wrap(err, "invalid ip-rate-limit"))
+	}
+	trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies)
 	if err != nil {
-		panic(errors.Wrap(err, "failed to deserialize private key"))
+		panic(errors.Wrap(err, "invalid trusted-proxies"))
 	}
+	clientIPHeader = cfg.ClientIPHeader
 
-	faucetPrivateKey, _ = secp256k1.DeserializeSchnorrPrivateKeyFromSlice(privateKeyBytes)
+	costOfChange, err := changeOutputCost(cfg.FeeRate)
+	if err != nil {
+		panic(errors.Wrap(err, "failed to calculate the cost of a change output"))
+	}
+	utxoSelector, err = newUTXOSelector(cfg.UTXOSelection, costOfChange)
+	if err != nil {
+		panic(errors.Wrap(err, "failed to create UTXO selector"))
+	}
+
+	utxoSpendPolicy = newSpendPolicy(cfg)
+	faucetWallet = newWallet(cfg.ChainUnconfirmedChange)
+	err = submittedTransactions.load()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to load pending transactions"))
+	}
+
+	if cfg.Consolidate {
+		err := runConsolidation(cfg)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to consolidate UTXOs"))
+		}
+		return
+	}
 
-	faucetAddress, err = privateKeyToP2PKHAddress(faucetPrivateKey, config.ActiveNetParams())
+	spawn("main-transactionTrackerLoop", transactionTrackerLoop)
+	spawn("main-ipRequestsPruneLoop", ipRequestsPruneLoop)
+	faucetRPCConnection = newRPCConnection(cfg.RPCServer, syncWallet)
+	defer faucetRPCConnection.close()
+	spawn("main-walletResyncLoop", walletResyncLoop)
+
+	payout, err = newPayoutPolicy(cfg)
 	if err != nil {
-		panic(errors.Errorf("Failed to get P2PKH address from private key: %s", err))
+		panic(errors.Wrap(err, "failed to create payout policy"))
+	}
+
+	// Pool UTXOs are kept out of consolidation, which would otherwise
+	// merge them right back
+	poolAmount := uint64(0)
+	if cfg.FanOutPoolSize > 0 {
+		pool, err := newUTXOPool(cfg.FanOutPoolSize, cfg.FeeRate)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create UTXO pool"))
+		}
+		poolDustThreshold, err := dustThreshold(faucetAddress)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to calculate the dust threshold"))
+		}
+		utxoSelector = &poolSelector{
+			poolAmount:    pool.amount,
+			costOfChange:  costOfChange,
+			dustThreshold: poolDustThreshold,
+			fallback:      utxoSelector,
+		}
+		spawn("main-fanOutLoop", func() { fanOutLoop(pool) })
+		poolAmount = pool.amount
+	}
+	if cfg.ConsolidationThreshold > 0 {
+		spawn("main-consolidationLoop", func() { consolidationLoop(cfg.ConsolidationThreshold, poolAmount) })
 	}
 
+	if len(cfg.LowBalanceThresholds) > 0 {
+		thresholds := make([]uint64, len(cfg.LowBalanceThresholds))
+		for i, threshold := range cfg.LowBalanceThresholds {
+			thresholds[i], err = kaspaToSompi(threshold)
+			if err != nil {
+				panic(errors.Wrap(err, "invalid low-balance-threshold"))
+			}
+		}
+		notifiers, err := newNotifiers(cfg)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to create the balance alert notifiers"))
+		}
+		monitor := newBalanceMonitor(thresholds, cfg.LowBalanceHysteresis, notifiers)
+		spawn("main-balanceMonitorLoop", func() { balanceMonitorLoop(monitor) })
+	}
+
+	if cfg.BatchInterval > 0 {
+		batcher = newPayoutBatcher(cfg.BatchInterval, cfg.BatchMaxRecipients)
+		spawn("main-batcher.run", batcher.run)
+	}
+	err = resumeQueuedPayoutRequests()
+	if err != nil {
+		panic(errors.Wrap(err, "failed to resume queued payout requests"))
+	}
+	spawn("main-payoutRequestsPruneLoop", payoutRequestsPruneLoop)
+
 	shutdownServer := startHTTPServer(cfg.HTTPListen)
 	defer shutdownServer()
 
 	<-interrupt
 }
 
-// privateKeyToP2PKHAddress generates p2pkh address from private key.
-func privateKeyToP2PKHAddress(key *secp256k1.SchnorrKeyPair, net *dagconfig.Params) (util.Address, error) {
-	publicKey, err := key.SchnorrPublicKey()
+// newSigner returns the signer that the given config chooses.
+func newSigner(cfg *config.Config) (signer.Signer, error) {
+	switch {
+	case cfg.SignerSocket != "":
+		return signer.NewRemoteSigner(cfg.SignerSocket), nil
+	case cfg.Keyfile != "":
+		accountKey, err := loadKeyfile(&cfg.KeyfileFlags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load the key file %s", cfg.Keyfile)
+		}
+		return signer.NewHDKeySigner(accountKey)
+	case cfg.ExtendedPrivateKey != "":
+		accountKey, err := keystore.ParseAccountKey(cfg.ExtendedPrivateKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load the extended private key")
+		}
+		return signer.NewHDKeySigner(accountKey)
+	}
+
+	return newSingleKeySigner(cfg.PrivateKey)
+}
+
+// newSingleKeySigner returns a signer of the given hex-encoded private key.
+func newSingleKeySigner(privateKeyHex string) (*signer.KeySigner, error) {
+	privateKeyBytes, err := hex.DecodeString(privateKeyHex)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "failed to deserialize private key")
+	}
+	privateKey, err := secp256k1.DeserializeSchnorrPrivateKeyFromSlice(privateKeyBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to deserialize private key")
+	}
+	return signer.NewSingleKeySigner(privateKey), nil
+}
+
+// newMultisigSigners returns the signers of minimumSignatures of the
+// cosigners of the given multisig keyring that the given config loads,
+// ordered like their public keys in its redeem script.
+func newMultisigSigners(keys *keyring, cfg *config.Config) ([]signer.Signer, error) {
+	cosigners := make([]signer.Signer, 0, len(cfg.MultisigKeyfiles)+len(cfg.MultisigSignerSockets))
+	for _, keyfile := range cfg.MultisigKeyfiles {
+		keyfileFlags := cfg.KeyfileFlags
+		keyfileFlags.Keyfile = keyfile
+		accountKey, err := loadKeyfile(&keyfileFlags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load the key file %s", keyfile)
+		}
+		cosigner, err := signer.NewHDKeySigner(accountKey)
+		if err != nil {
+			return nil, err
+		}
+		cosigners = append(cosigners, cosigner)
+	}
+	for _, socketPath := range cfg.MultisigSignerSockets {
+		cosigners = append(cosigners, signer.NewRemoteSigner(socketPath))
+	}
+
+	signersByIndex := make(map[int]signer.Signer)
+	for _, cosigner := range cosigners {
+		multisigSigner, publicKey, err := newMultisigCosigner(cosigner)
+		if err != nil {
+			return nil, err
+		}
+		index, ok := keys.cosignerIndex(publicKey)
+		if !ok {
+			return nil, errors.Errorf("the public key %s isn't of a cosigner", publicKey)
+		}
+		signersByIndex[index] = multisigSigner
+	}
+	if uint32(len(signersByIndex)) < cfg.MultisigMinimumSignatures {
+		return nil, errors.Errorf("%d distinct cosigners are required, but only %d were given",
+			cfg.MultisigMinimumSignatures, len(signersByIndex))
+	}
+
+	indexes := make([]int, 0, len(signersByIndex))
+	for index := range signersByIndex {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	signers := make([]signer.Signer, cfg.MultisigMinimumSignatures)
+	for i := range signers {
+		signers[i] = signersByIndex[indexes[i]]
+	}
+	return signers, nil
+}
+
+// multisigCosignerPath is the derivation path of the key that an HD
+// cosigner signs with, relative to its account key. It's the key of the
+// receive address of the cosigner's own key file.
+var multisigCosignerPath = fmt.Sprintf("m/%d/%d", externalKeychain, 0)
+
+// multisigCosigner is the Signer of a multisig cosigner, which signs
+// every input with the same key.
+type multisigCosigner struct {
+	signer.Signer
+
+	// derivationPath is the path of the cosigner's key relative to the
+	// account key of an HD signer. It's empty for single-key signers.
+	derivationPath string
+}
+
+// newMultisigCosigner returns the multisig cosigner of the given signer,
+// and the hex of its public key.
+func newMultisigCosigner(cosigner signer.Signer) (*multisigCosigner, string, error) {
+	account, err := cosigner.Account()
+	if err != nil {
+		return nil, "", err
+	}
+	if account.ExtendedPublicKey == "" {
+		return &multisigCosigner{Signer: cosigner}, account.PublicKey, nil
+	}
+	publicKey, err := multisigPublicKeyOf(account.ExtendedPublicKey)
+	if err != nil {
+		return nil, "", err
 	}
+	return &multisigCosigner{Signer: cosigner, derivationPath: multisigCosignerPath}, publicKey, nil
+}
+
+// Sign implements signer.Signer.
+func (c *multisigCosigner) Sign(transaction *externalapi.DomainTransaction, inputs []*signer.Input) (
+	[][]byte, error) {
+
+	cosignerInputs := make([]*signer.Input, len(inputs))
+	for i, input := range inputs {
+		cosignerInputs[i] = &signer.Input{Index: input.Index, DerivationPath: c.derivationPath}
+	}
+	return c.Signer.Sign(transaction, cosignerInputs)
+}
+
+// publicKeyToP2PKHAddress generates p2pkh address from public key.
+func publicKeyToP2PKHAddress(publicKey *secp256k1.SchnorrPublicKey, net *dagconfig.Params) (util.Address, error) {
 	serialized, err := publicKey.Serialize()
 	if err != nil {
 		return nil, err
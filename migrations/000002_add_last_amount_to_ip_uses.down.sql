@@ -0,0 +1,2 @@
+ALTER TABLE ip_uses
+    DROP COLUMN last_amount;
@@ -0,0 +1,2 @@
+ALTER TABLE ip_uses
+    ADD COLUMN last_amount BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,13 @@
+CREATE TABLE transactions
+(
+    transaction_id      CHAR(64)    NOT NULL,
+    payments            JSONB       NOT NULL,
+    fee                 BIGINT      NOT NULL,
+    inputs              TEXT[]      NOT NULL,
+    submit_time         TIMESTAMP   NOT NULL,
+    status              VARCHAR(16) NOT NULL,
+    accepted_blue_score BIGINT      NOT NULL DEFAULT 0,
+    PRIMARY KEY (transaction_id)
+);
+
+CREATE INDEX idx_transactions_status ON transactions (status);
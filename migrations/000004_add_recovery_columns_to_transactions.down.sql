@@ -0,0 +1,3 @@
+ALTER TABLE transactions
+    DROP COLUMN attempt,
+    DROP COLUMN replaced_by;
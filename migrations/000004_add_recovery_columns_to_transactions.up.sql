@@ -0,0 +1,3 @@
+ALTER TABLE transactions
+    ADD COLUMN attempt     INT NOT NULL DEFAULT 1,
+    ADD COLUMN replaced_by CHAR(64);
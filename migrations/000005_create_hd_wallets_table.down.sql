@@ -0,0 +1 @@
+DROP TABLE hd_wallets;
@@ -0,0 +1,6 @@
+CREATE TABLE hd_wallets
+(
+    extended_public_key TEXT NOT NULL,
+    next_change_index   INT  NOT NULL DEFAULT 0,
+    PRIMARY KEY (extended_public_key)
+);
@@ -0,0 +1 @@
+DROP TABLE address_uses;
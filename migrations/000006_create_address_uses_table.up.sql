@@ -0,0 +1,7 @@
+CREATE TABLE address_uses
+(
+    address     VARCHAR(100) NOT NULL,
+    last_use    TIMESTAMP    NOT NULL,
+    last_amount BIGINT       NOT NULL DEFAULT 0,
+    PRIMARY KEY (address)
+);
@@ -0,0 +1,4 @@
+DELETE FROM ip_uses
+WHERE LENGTH(ip) > 39;
+ALTER TABLE ip_uses
+    ALTER COLUMN ip TYPE VARCHAR(39);
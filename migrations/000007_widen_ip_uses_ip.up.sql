@@ -0,0 +1,4 @@
+-- Rate limits of IPv6 networks are kept under keys such as
+-- 2001:db8:0:1:2:3:4:0/120, which are longer than an IPv6 address.
+ALTER TABLE ip_uses
+    ALTER COLUMN ip TYPE VARCHAR(43);
@@ -0,0 +1,14 @@
+CREATE TABLE ip_uses
+(
+    ip          VARCHAR(43) NOT NULL,
+    last_use    TIMESTAMP   NOT NULL,
+    last_amount BIGINT      NOT NULL DEFAULT 0,
+    PRIMARY KEY (ip)
+);
+
+INSERT INTO ip_uses (ip, last_use, last_amount)
+SELECT DISTINCT ON (ip) ip, request_time, amount
+FROM ip_requests
+ORDER BY ip, request_time DESC;
+
+DROP TABLE ip_requests;
@@ -0,0 +1,15 @@
+CREATE TABLE ip_requests
+(
+    id           BIGSERIAL   NOT NULL,
+    ip           VARCHAR(43) NOT NULL,
+    request_time TIMESTAMP   NOT NULL,
+    amount       BIGINT      NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+CREATE INDEX ip_requests_ip_request_time_idx ON ip_requests (ip, request_time);
+
+INSERT INTO ip_requests (ip, request_time, amount)
+SELECT ip, last_use, last_amount
+FROM ip_uses;
+
+DROP TABLE ip_uses;
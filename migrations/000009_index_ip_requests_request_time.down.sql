@@ -0,0 +1 @@
+DROP INDEX ip_requests_request_time_idx;
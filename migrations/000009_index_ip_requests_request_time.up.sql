@@ -0,0 +1 @@
+CREATE INDEX ip_requests_request_time_idx ON ip_requests (request_time);
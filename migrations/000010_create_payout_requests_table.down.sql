@@ -0,0 +1 @@
+DROP TABLE payout_requests;
@@ -0,0 +1,19 @@
+CREATE TABLE payout_requests
+(
+    id                 CHAR(32)     NOT NULL,
+    address            VARCHAR(100) NOT NULL,
+    requested_amount   BIGINT       NOT NULL,
+    ip                 VARCHAR(43)  NOT NULL,
+    ip_request_id      BIGINT,
+    address_claim_time TIMESTAMP,
+    created_at         TIMESTAMP    NOT NULL,
+    state              VARCHAR(16)  NOT NULL,
+    amount             BIGINT       NOT NULL DEFAULT 0,
+    transaction_id     CHAR(64),
+    error              TEXT,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX idx_payout_requests_state ON payout_requests (state);
+CREATE INDEX idx_payout_requests_transaction_id ON payout_requests (transaction_id);
+CREATE INDEX idx_payout_requests_created_at ON payout_requests (created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE hd_wallets
+    DROP COLUMN first_watched_change_index;
@@ -0,0 +1,2 @@
+ALTER TABLE hd_wallets
+    ADD COLUMN first_watched_change_index INT NOT NULL DEFAULT 0;
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/pkg/errors"
+)
+
+// webhookTimeout is how long a webhook notifier waits for a response.
+const webhookTimeout = 10 * time.Second
+
+type balanceAlertKind string
+
+const (
+	balanceAlertKindLow       balanceAlertKind = "low_balance"
+	balanceAlertKindRecovered balanceAlertKind = "balance_recovered"
+)
+
+// balanceAlert is sent when the spendable balance of the faucet falls
+// below a threshold, or rises back above it.
+type balanceAlert struct {
+	Kind           balanceAlertKind `json:"kind"`
+	Address        string           `json:"address"`
+	BalanceSompi   uint64           `json:"balanceSompi"`
+	ThresholdSompi uint64           `json:"thresholdSompi"`
+}
+
+func (a *balanceAlert) String() string {
+	if a.Kind == balanceAlertKindRecovered {
+		return fmt.Sprintf("The spendable balance of faucet %s recovered to %d sompi, above %d sompi",
+			a.Address, a.BalanceSompi, a.ThresholdSompi)
+	}
+	return fmt.Sprintf("The spendable balance of faucet %s fell to %d sompi, below %d sompi",
+		a.Address, a.BalanceSompi, a.ThresholdSompi)
+}
+
+// Notifier delivers balance alerts to the faucet's operators.
+type Notifier interface {
+	Notify(alert *balanceAlert) error
+}
+
+// newNotifiers returns the notifiers that are enabled in the given config.
+// Alerts are always logged.
+func newNotifiers(cfg *config.Config) ([]Notifier, error) {
+	notifiers := []Notifier{logNotifier{}}
+	if cfg.AlertWebhook != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    cfg.AlertWebhook,
+			client: &http.Client{Timeout: webhookTimeout},
+		})
+	}
+	if cfg.AlertSMTPServer != "" {
+		password := ""
+		if cfg.AlertSMTPUser != "" {
+			var err error
+			password, err = cfg.AlertSMTPPassword()
+			if err != nil {
+				return nil, err
+			}
+		}
+		notifiers = append(notifiers, &smtpNotifier{
+			server:   cfg.AlertSMTPServer,
+			user:     cfg.AlertSMTPUser,
+			password: password,
+			from:     cfg.AlertEmailFrom,
+			to:       cfg.AlertEmailTo,
+		})
+	}
+	return notifiers, nil
+}
+
+// logNotifier writes alerts to the faucet's log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(alert *balanceAlert) error {
+	if alert.Kind == balanceAlertKindRecovered {
+		log.Infof("%s", alert)
+		return nil
+	}
+	log.Warnf("%s", alert)
+	return nil
+}
+
+// webhookNotifier posts alerts as JSON to an HTTP endpoint.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	balanceAlert
+	Message string `json:"message"`
+}
+
+func (n *webhookNotifier) Notify(alert *balanceAlert) error {
+	body, err := json.Marshal(&webhookPayload{balanceAlert: *alert, Message: alert.String()})
+	if err != nil {
+		return err
+	}
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error posting the alert to the webhook")
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.Errorf("the webhook responded with status %s", response.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails alerts through an SMTP server.
+type smtpNotifier struct {
+	server   string
+	user     string
+	password string
+	from     string
+	to       []string
+}
+
+func (n *smtpNotifier) Notify(alert *balanceAlert) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, err := net.SplitHostPort(n.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+	subject := "Faucet balance is low"
+	if alert.Kind == balanceAlertKindRecovered {
+		subject = "Faucet balance recovered"
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), subject, alert)
+	return smtp.SendMail(n.server, auth, n.from, n.to, []byte(message))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// payoutBatcher collects payout requests and pays them together in a
+// single transaction, either every interval or as soon as maxRecipients
+// requests are queued, whichever comes first.
+type payoutBatcher struct {
+	interval      time.Duration
+	maxRecipients int
+
+	lock      sync.Mutex
+	queue     []*payoutRequest
+	flushChan chan struct{}
+}
+
+// batcher is nil when batching is disabled.
+var batcher *payoutBatcher
+
+func newPayoutBatcher(interval time.Duration, maxRecipients int) *payoutBatcher {
+	return &payoutBatcher{
+		interval:      interval,
+		maxRecipients: maxRecipients,
+		flushChan:     make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds the given request to the next batch.
+func (b *payoutBatcher) enqueue(request *payoutRequest) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.queue = append(b.queue, request)
+	if len(b.queue) >= b.maxRecipients {
+		select {
+		case b.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *payoutBatcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flushChan:
+		}
+		b.flush()
+	}
+}
+
+// flush pays the queued requests, up to maxRecipients at a time.
+func (b *payoutBatcher) flush() {
+	for {
+		batch := b.takeBatch()
+		if len(batch) == 0 {
+			return
+		}
+
+		batch = withoutDustRequests(batch)
+		if len(batch) == 0 {
+			continue
+		}
+
+		client, err := faucetRPCConnection.connectedClient()
+		if err != nil {
+			log.Warnf("Postponing a batch of %d payouts: %s", len(batch), err)
+			b.requeue(batch)
+			return
+		}
+
+		err = processPayoutRequests(client, batch)
+		if err != nil {
+			log.Errorf("Error sending a batch of %d payouts: %s", len(batch), err)
+			continue
+		}
+		log.Infof("Sent a batch of %d payouts in transaction %s", len(batch), batch[0].transactionID)
+	}
+}
+
+func (b *payoutBatcher) takeBatch() []*payoutRequest {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	batchSize := len(b.queue)
+	if batchSize > b.maxRecipients {
+		batchSize = b.maxRecipients
+	}
+	batch := b.queue[:batchSize:batchSize]
+	b.queue = b.queue[batchSize:]
+	return batch
+}
+
+// requeue puts the given requests back at the front of the queue.
+func (b *payoutBatcher) requeue(requests []*payoutRequest) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.queue = append(requests, b.queue...)
+}
+
+// withoutDustRequests fails the given requests whose amount the mempool
+// would reject as dust, and returns the rest. A single dust output gets
+// the whole transaction rejected, so such a request would otherwise fail
+// every other request in its batch.
+func withoutDustRequests(requests []*payoutRequest) []*payoutRequest {
+	payableRequests := make([]*payoutRequest, 0, len(requests))
+	for _, request := range requests {
+		threshold, err := dustThreshold(request.address)
+		if err == nil && request.requestedAmount < threshold {
+			err = errors.Errorf("amount %d is below the dust threshold of %d", request.requestedAmount, threshold)
+		}
+		if err != nil {
+			log.Warnf("Dropping payout request %s from its batch: %s", request.id, err)
+			failPayoutRequests([]*payoutRequest{request}, err)
+			continue
+		}
+		payableRequests = append(payableRequests, request)
+	}
+	return payableRequests
+}
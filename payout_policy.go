@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+// payoutPolicy decides how many sompi are sent for a single request.
+type payoutPolicy struct {
+	// defaultAmount is sent when the caller doesn't ask for a specific amount.
+	defaultAmount uint64
+
+	// minAmount and maxAmount bound the amount a caller may ask for.
+	// When maxAmount is zero, callers can't choose the amount.
+	minAmount uint64
+	maxAmount uint64
+
+	// balanceScalingThreshold is the spendable balance below which
+	// payouts shrink proportionally to the balance. Zero disables scaling.
+	balanceScalingThreshold uint64
+
+	// dustThreshold is the smallest amount that is never rejected as
+	// dust, whatever the recipient address is. No payout is smaller.
+	dustThreshold uint64
+}
+
+var payout *payoutPolicy
+
+func newPayoutPolicy(cfg *config.Config) (*payoutPolicy, error) {
+	defaultAmount, err := kaspaToSompi(cfg.Amount)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid amount")
+	}
+	dustThreshold, err := recipientDustThreshold()
+	if err != nil {
+		return nil, err
+	}
+	if defaultAmount < dustThreshold {
+		return nil, errors.Errorf("amount must be at least the dust threshold of %s", util.Amount(dustThreshold))
+	}
+	minAmount, err := kaspaToSompi(cfg.MinAmount)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid min-amount")
+	}
+	if minAmount != 0 && minAmount < dustThreshold {
+		return nil, errors.Errorf("min-amount must be at least the dust threshold of %s", util.Amount(dustThreshold))
+	}
+	maxAmount, err := kaspaToSompi(cfg.MaxAmount)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid max-amount")
+	}
+	balanceScalingThreshold, err := kaspaToSompi(cfg.BalanceScalingThreshold)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid balance-scaling-threshold")
+	}
+	return &payoutPolicy{
+		defaultAmount:           defaultAmount,
+		minAmount:               minAmount,
+		maxAmount:               maxAmount,
+		balanceScalingThreshold: balanceScalingThreshold,
+		dustThreshold:           dustThreshold,
+	}, nil
+}
+
+func kaspaToSompi(kaspa float64) (uint64, error) {
+	amount, err := util.NewAmount(kaspa)
+	if err != nil {
+		return 0, err
+	}
+	if amount < 0 {
+		return 0, errors.Errorf("amount %f is negative", kaspa)
+	}
+	return uint64(amount), nil
+}
+
+// requestedAmount returns the amount in sompi the caller asked for using
+// the amount query parameter, or the default amount if they didn't ask for one.
+func (p *payoutPolicy) requestedAmount(queryParams map[string]string) (uint64, error) {
+	amountString, ok := queryParams["amount"]
+	if !ok {
+		return p.defaultAmount, nil
+	}
+	if p.maxAmount == 0 {
+		return 0, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
+			errors.Errorf("amount was requested while custom amounts are disabled"),
+			"This faucet doesn't allow choosing the amount")
+	}
+	amountKaspa, err := strconv.ParseFloat(amountString, 64)
+	if err != nil {
+		return 0, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
+			errors.Wrap(err, "Error parsing amount"),
+			"Error parsing amount")
+	}
+	amount, err := kaspaToSompi(amountKaspa)
+	if err != nil {
+		return 0, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
+			errors.Wrap(err, "Error parsing amount"),
+			"Error parsing amount")
+	}
+	// Amounts below the dust threshold would be rejected by the mempool
+	minAmount := p.minAmount
+	if minAmount < p.dustThreshold {
+		minAmount = p.dustThreshold
+	}
+	if amount < minAmount || amount > p.maxAmount {
+		return 0, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
+			errors.Errorf("amount %d is out of range", amount),
+			fmt.Sprintf("The amount must be between %s and %s",
+				util.Amount(minAmount), util.Amount(p.maxAmount)))
+	}
+	return amount, nil
+}
+
+// scaleByBalance shrinks the given amount proportionally to how far the
+// spendable balance has dropped below the balance scaling threshold, but
+// never below the dust threshold.
+func (p *payoutPolicy) scaleByBalance(amount uint64, balance uint64) uint64 {
+	if p.balanceScalingThreshold == 0 || balance >= p.balanceScalingThreshold {
+		return amount
+	}
+	scaledAmount := uint64(float64(amount) * float64(balance) / float64(p.balanceScalingThreshold))
+	if scaledAmount < p.dustThreshold {
+		scaledAmount = p.dustThreshold
+	}
+	if scaledAmount > amount {
+		return amount
+	}
+	return scaledAmount
+}
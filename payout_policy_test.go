@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/pkg/errors"
+)
+
+func TestRequestedAmount(t *testing.T) {
+	policy := &payoutPolicy{
+		defaultAmount: 100_000_000,
+		maxAmount:     1_000_000_000,
+		dustThreshold: 603,
+	}
+	tests := []struct {
+		name           string
+		queryParams    map[string]string
+		expectedAmount uint64
+		expectsError   bool
+	}{
+		{name: "default amount", queryParams: map[string]string{}, expectedAmount: 100_000_000},
+		{name: "custom amount", queryParams: map[string]string{"amount": "2"}, expectedAmount: 200_000_000},
+		{name: "at the dust threshold", queryParams: map[string]string{"amount": "0.00000603"}, expectedAmount: 603},
+		{name: "below the dust threshold", queryParams: map[string]string{"amount": "0.00000602"}, expectsError: true},
+		{name: "below one sompi", queryParams: map[string]string{"amount": "0.000000001"}, expectsError: true},
+		{name: "above the maximum", queryParams: map[string]string{"amount": "11"}, expectsError: true},
+		{name: "malformed", queryParams: map[string]string{"amount": "a lot"}, expectsError: true},
+	}
+
+	for _, test := range tests {
+		amount, err := policy.requestedAmount(test.queryParams)
+		if test.expectsError {
+			var handlerErr *httpserverutils.HandlerError
+			if !errors.As(err, &handlerErr) || handlerErr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected a 422 error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if amount != test.expectedAmount {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expectedAmount, amount)
+		}
+	}
+}
+
+func TestScaleByBalance(t *testing.T) {
+	policy := &payoutPolicy{
+		balanceScalingThreshold: 1_000_000,
+		dustThreshold:           603,
+	}
+	tests := []struct {
+		name           string
+		amount         uint64
+		balance        uint64
+		expectedAmount uint64
+	}{
+		{name: "balance above the threshold", amount: 10_000, balance: 2_000_000, expectedAmount: 10_000},
+		{name: "half the threshold", amount: 10_000, balance: 500_000, expectedAmount: 5_000},
+		{name: "scaled below the dust threshold", amount: 10_000, balance: 10_000, expectedAmount: 603},
+		{name: "empty balance", amount: 10_000, balance: 0, expectedAmount: 603},
+		{name: "amount below the dust threshold", amount: 500, balance: 10_000, expectedAmount: 500},
+	}
+
+	for _, test := range tests {
+		amount := policy.scaleByBalance(test.amount, test.balance)
+		if amount != test.expectedAmount {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expectedAmount, amount)
+		}
+	}
+}
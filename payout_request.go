@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// payoutRequestRetention is how long a payout request is kept
+	// after it was created.
+	payoutRequestRetention = 24 * time.Hour
+
+	// payoutRequestsPruneInterval is the interval between prunes of the
+	// stored payout requests that are past their retention.
+	payoutRequestsPruneInterval = time.Hour
+)
+
+// errFaucetRestarted is the error of queued payout requests that can't
+// be paid after the faucet restarted.
+var errFaucetRestarted = errors.New("the faucet restarted before paying the request")
+
+type payoutRequestState string
+
+const (
+	payoutRequestStateQueued    payoutRequestState = "queued"
+	payoutRequestStateSubmitted payoutRequestState = "submitted"
+	payoutRequestStateAccepted  payoutRequestState = "accepted"
+	payoutRequestStateConfirmed payoutRequestState = "confirmed"
+	payoutRequestStateFailed    payoutRequestState = "failed"
+)
+
+// payoutRequest is a request for the faucet to pay some address.
+type payoutRequest struct {
+	id              string
+	address         util.Address
+	requestedAmount uint64
+	ip              string
+	usageClaims     []usageClaim
+	createdAt       time.Time
+	state           payoutRequestState
+
+	// amount and transactionID are set once the request is submitted.
+	amount        uint64
+	transactionID string
+
+	// err is set if the request failed.
+	err error
+}
+
+// usageClaim is a rate limit slot claimed for a payout request. It's
+// committed with the paid amount once the payout is sent, or rolled
+// back if the payout fails.
+type usageClaim interface {
+	commit(amountSompi uint64) error
+	rollback() error
+}
+
+// storedPayoutRequest is a payout request, as stored in the
+// payout_requests table.
+type storedPayoutRequest struct {
+	tableName struct{} `pg:"payout_requests"`
+
+	ID               string `pg:",pk"`
+	Address          string
+	RequestedAmount  uint64
+	IP               string `pg:",use_zero"`
+	IPRequestID      int64
+	AddressClaimTime time.Time
+	CreatedAt        time.Time
+	State            payoutRequestState
+	Amount           uint64 `pg:",use_zero"`
+	TransactionID    string
+	Error            string
+}
+
+func newStoredPayoutRequest(request *payoutRequest) *storedPayoutRequest {
+	stored := &storedPayoutRequest{
+		ID:              request.id,
+		Address:         request.address.EncodeAddress(),
+		RequestedAmount: request.requestedAmount,
+		IP:              request.ip,
+		CreatedAt:       request.createdAt,
+		State:           request.state,
+		Amount:          request.amount,
+		TransactionID:   request.transactionID,
+	}
+	stored.IPRequestID, stored.AddressClaimTime = usageClaimKeys(request.usageClaims)
+	if request.err != nil {
+		stored.Error = request.err.Error()
+	}
+	return stored
+}
+
+// payoutRequest returns the payout request of the stored record,
+// along with the rate limit slots it claimed.
+func (r *storedPayoutRequest) payoutRequest() (*payoutRequest, error) {
+	address, err := util.DecodeAddress(r.Address, config.ActiveNetParams().Prefix)
+	if err != nil {
+		return nil, err
+	}
+	request := &payoutRequest{
+		id:              r.ID,
+		address:         address,
+		requestedAmount: r.RequestedAmount,
+		ip:              r.IP,
+		usageClaims:     usageClaimsOf(r.IPRequestID, r.Address, r.AddressClaimTime),
+		createdAt:       r.CreatedAt,
+		state:           r.State,
+		amount:          r.Amount,
+		transactionID:   r.TransactionID,
+	}
+	if r.Error != "" {
+		request.err = errors.New(r.Error)
+	}
+	return request, nil
+}
+
+// usageClaimKeys returns the keys that the given claims are stored by:
+// the ID of the claimed IP request, and the time the address was claimed.
+// Either is zero if it wasn't claimed.
+func usageClaimKeys(claims []usageClaim) (ipRequestID int64, addressClaimTime time.Time) {
+	for _, claim := range claims {
+		switch claim := claim.(type) {
+		case *ipUsageClaim:
+			ipRequestID = claim.requestID
+		case *addressUsageClaim:
+			addressClaimTime = claim.claimTime
+		}
+	}
+	return ipRequestID, addressClaimTime
+}
+
+// usageClaimsOf returns the claims that were stored by the given keys,
+// as returned by usageClaimKeys.
+func usageClaimsOf(ipRequestID int64, address string, addressClaimTime time.Time) []usageClaim {
+	var claims []usageClaim
+	if ipRequestID != 0 {
+		claims = append(claims, &ipUsageClaim{requestID: ipRequestID})
+	}
+	if !addressClaimTime.IsZero() {
+		claims = append(claims, &addressUsageClaim{address: address, claimTime: addressClaimTime})
+	}
+	return claims
+}
+
+// payoutRequestStore keeps the payout requests so that callers can
+// resolve their request IDs. Requests are stored in the database, so
+// that they survive restarts, and the recent ones are also kept in
+// memory.
+type payoutRequestStore struct {
+	lock                   sync.RWMutex
+	requests               map[string]*payoutRequest
+	requestsByTransactions map[string][]*payoutRequest
+}
+
+var payoutRequests = &payoutRequestStore{
+	requests:               make(map[string]*payoutRequest),
+	requestsByTransactions: make(map[string][]*payoutRequest),
+}
+
+// add creates a new queued payout request and stores it.
+func (s *payoutRequestStore) add(address util.Address, requestedAmount uint64, ip string,
+	usageClaims []usageClaim) (*payoutRequest, error) {
+
+	id, err := newPayoutRequestID()
+	if err != nil {
+		return nil, err
+	}
+	request := &payoutRequest{
+		id:              id,
+		address:         address,
+		requestedAmount: requestedAmount,
+		ip:              ip,
+		usageClaims:     usageClaims,
+		createdAt:       time.Now(),
+		state:           payoutRequestStateQueued,
+	}
+	db, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Model(newStoredPayoutRequest(request)).Insert()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pruneExpired()
+	s.requests[id] = request
+	return request, nil
+}
+
+// get returns a copy of the payout request with the given ID. Requests
+// that aren't in memory, such as those created before a restart, are
+// read from the database.
+func (s *payoutRequestStore) get(id string) (payoutRequest, bool, error) {
+	s.lock.RLock()
+	request, ok := s.requests[id]
+	if ok {
+		requestCopy := *request
+		s.lock.RUnlock()
+		return requestCopy, true, nil
+	}
+	s.lock.RUnlock()
+
+	db, err := database.DB()
+	if err != nil {
+		return payoutRequest{}, false, err
+	}
+	stored := &storedPayoutRequest{}
+	err = db.Model(stored).
+		Where("id = ?", id).
+		Where("created_at >= ?", time.Now().Add(-payoutRequestRetention)).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return payoutRequest{}, false, nil
+	}
+	if err != nil {
+		return payoutRequest{}, false, err
+	}
+	request, err = stored.payoutRequest()
+	if err != nil {
+		return payoutRequest{}, false, err
+	}
+	return *request, true, nil
+}
+
+// loadQueued returns the stored payout requests that were still queued
+// when the faucet stopped, oldest first, and keeps them in memory.
+func (s *payoutRequestStore) loadQueued() ([]*payoutRequest, error) {
+	db, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	var storedRequests []*storedPayoutRequest
+	err = db.Model(&storedRequests).
+		Where("state = ?", payoutRequestStateQueued).
+		Order("created_at").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := make([]*payoutRequest, len(storedRequests))
+	for i, stored := range storedRequests {
+		requests[i], err = stored.payoutRequest()
+		if err != nil {
+			return nil, err
+		}
+		s.requests[requests[i].id] = requests[i]
+	}
+	return requests, nil
+}
+
+// setSubmitted marks the given requests as paid by the given transaction.
+func (s *payoutRequestStore) setSubmitted(requests []*payoutRequest, amounts []uint64, transactionID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, request := range requests {
+		request.amount = amounts[i]
+		request.transactionID = transactionID
+		request.state = payoutRequestStateSubmitted
+		s.update(request, "amount", "transaction_id", "state")
+	}
+	s.requestsByTransactions[transactionID] = requests
+}
+
+// setFailed marks the given requests as failed with the given error.
+func (s *payoutRequestStore) setFailed(requests []*payoutRequest, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, request := range requests {
+		request.err = err
+		request.state = payoutRequestStateFailed
+		s.update(request, "error", "state")
+	}
+}
+
+// setTransactionState sets the state of all the requests
+// paid by the given transaction.
+func (s *payoutRequestStore) setTransactionState(transactionID string, state payoutRequestState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, request := range s.requestsByTransactions[transactionID] {
+		request.state = state
+	}
+	s.updateTransaction(transactionID, "state = ?", state)
+}
+
+// setTransactionReplaced moves the requests paid by the given dropped
+// transaction to the transaction that replaced it.
+func (s *payoutRequestStore) setTransactionReplaced(transactionID string, replacingTransactionID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := s.requestsByTransactions[transactionID]
+	for _, request := range requests {
+		request.transactionID = replacingTransactionID
+		request.state = payoutRequestStateSubmitted
+	}
+	delete(s.requestsByTransactions, transactionID)
+	s.requestsByTransactions[replacingTransactionID] = requests
+	s.updateTransaction(transactionID, "transaction_id = ?, state = ?",
+		replacingTransactionID, payoutRequestStateSubmitted)
+}
+
+// setTransactionFailed marks all the requests paid by the given
+// transaction as failed with the given error.
+func (s *payoutRequestStore) setTransactionFailed(transactionID string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, request := range s.requestsByTransactions[transactionID] {
+		request.err = err
+		request.state = payoutRequestStateFailed
+	}
+	s.updateTransaction(transactionID, "error = ?, state = ?", err.Error(), payoutRequestStateFailed)
+}
+
+// update stores the given columns of the given request.
+func (s *payoutRequestStore) update(request *payoutRequest, columns ...string) {
+	db, err := database.DB()
+	if err == nil {
+		_, err = db.Model(newStoredPayoutRequest(request)).Column(columns...).WherePK().Update()
+	}
+	if err != nil {
+		log.Errorf("Error updating payout request %s: %s", request.id, err)
+	}
+}
+
+// updateTransaction sets the given columns of all the stored requests
+// paid by the given transaction, including those that aren't in memory.
+func (s *payoutRequestStore) updateTransaction(transactionID string, set string, params ...interface{}) {
+	db, err := database.DB()
+	if err == nil {
+		_, err = db.Model(&storedPayoutRequest{}).
+			Set(set, params...).
+			Where("transaction_id = ?", transactionID).
+			Update()
+	}
+	if err != nil {
+		log.Errorf("Error updating the payout requests of transaction %s: %s", transactionID, err)
+	}
+}
+
+func (s *payoutRequestStore) pruneExpired() {
+	expiry := time.Now().Add(-payoutRequestRetention)
+	for id, request := range s.requests {
+		if request.createdAt.Before(expiry) {
+			delete(s.requests, id)
+			delete(s.requestsByTransactions, request.transactionID)
+		}
+	}
+}
+
+// pruneStored deletes the stored requests that are past their retention
+// and aren't queued anymore.
+func (s *payoutRequestStore) pruneStored() error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&storedPayoutRequest{}).
+		Where("created_at < ?", time.Now().Add(-payoutRequestRetention)).
+		Where("state != ?", payoutRequestStateQueued).
+		Delete()
+	return err
+}
+
+// payoutRequestsPruneLoop periodically prunes the stored payout requests
+// that are past their retention.
+func payoutRequestsPruneLoop() {
+	for range time.Tick(payoutRequestsPruneInterval) {
+		err := payoutRequests.pruneStored()
+		if err != nil {
+			log.Errorf("Error pruning payout requests: %s", err)
+		}
+	}
+}
+
+// resumeQueuedPayoutRequests takes over the payout requests that were
+// still queued when the faucet stopped. They're queued again if batching
+// is enabled. Otherwise there's no one waiting on them anymore, so they
+// fail, and their rate limit slots are freed for the callers to retry.
+func resumeQueuedPayoutRequests() error {
+	requests, err := payoutRequests.loadQueued()
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	if batcher != nil {
+		for _, request := range requests {
+			batcher.enqueue(request)
+		}
+		log.Infof("Queued %d payout requests again", len(requests))
+		return nil
+	}
+	failPayoutRequests(requests, errFaucetRestarted)
+	log.Infof("Failed %d payout requests that were queued before the restart", len(requests))
+	return nil
+}
+
+func newPayoutRequestID() (string, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/kaspad/util"
+)
+
+func TestQueuedPayoutRequestsSurviveRestart(t *testing.T) {
+	connectTestDatabase(t)
+	_, err := config.ParseKeygen([]string{"--keyfile=unused", "--testnet"})
+	if err != nil {
+		t.Fatalf("Error choosing the network: %s", err)
+	}
+	address, err := util.NewAddressPublicKey(make([]byte, util.PublicKeySize), config.ActiveNetParams().Prefix)
+	if err != nil {
+		t.Fatalf("Error creating an address: %s", err)
+	}
+	claimTime := time.Now().Truncate(time.Microsecond)
+	claims := []usageClaim{
+		&ipUsageClaim{requestID: 12345},
+		&addressUsageClaim{address: address.EncodeAddress(), claimTime: claimTime},
+	}
+
+	store := &payoutRequestStore{
+		requests:               make(map[string]*payoutRequest),
+		requestsByTransactions: make(map[string][]*payoutRequest),
+	}
+	request, err := store.add(address, 100_000_000, "1.2.3.4", claims)
+	if err != nil {
+		t.Fatalf("Error adding a payout request: %s", err)
+	}
+	t.Cleanup(func() {
+		db, err := database.DB()
+		if err != nil {
+			return
+		}
+		_, err = db.Model(&storedPayoutRequest{}).Where("id = ?", request.id).Delete()
+		if err != nil {
+			t.Errorf("Error deleting payout request %s: %s", request.id, err)
+		}
+	})
+
+	// A new store has nothing in memory, like after a restart
+	restartedStore := &payoutRequestStore{
+		requests:               make(map[string]*payoutRequest),
+		requestsByTransactions: make(map[string][]*payoutRequest),
+	}
+	storedRequest, ok, err := restartedStore.get(request.id)
+	if err != nil {
+		t.Fatalf("Error getting payout request %s: %s", request.id, err)
+	}
+	if !ok || storedRequest.state != payoutRequestStateQueued {
+		t.Fatalf("Expected payout request %s to be queued, got %t and %s", request.id, ok, storedRequest.state)
+	}
+
+	queuedRequests, err := restartedStore.loadQueued()
+	if err != nil {
+		t.Fatalf("Error loading the queued payout requests: %s", err)
+	}
+	var loadedRequest *payoutRequest
+	for _, queuedRequest := range queuedRequests {
+		if queuedRequest.id == request.id {
+			loadedRequest = queuedRequest
+		}
+	}
+	if loadedRequest == nil {
+		t.Fatalf("Payout request %s wasn't loaded", request.id)
+	}
+	if loadedRequest.address.EncodeAddress() != address.EncodeAddress() ||
+		loadedRequest.requestedAmount != 100_000_000 || loadedRequest.ip != "1.2.3.4" {
+		t.Errorf("Loaded payout request %+v doesn't match the stored one", loadedRequest)
+	}
+	if len(loadedRequest.usageClaims) != 2 {
+		t.Fatalf("Expected 2 usage claims, got %d", len(loadedRequest.usageClaims))
+	}
+	ipClaim, ok := loadedRequest.usageClaims[0].(*ipUsageClaim)
+	if !ok || ipClaim.requestID != 12345 {
+		t.Errorf("Unexpected IP usage claim %+v", loadedRequest.usageClaims[0])
+	}
+	// TIMESTAMP columns keep the wall clock time without its time zone
+	const wallClockLayout = "2006-01-02 15:04:05.999999"
+	addressClaim, ok := loadedRequest.usageClaims[1].(*addressUsageClaim)
+	if !ok || addressClaim.claimTime.Format(wallClockLayout) != claimTime.Format(wallClockLayout) {
+		t.Errorf("Unexpected address usage claim %+v", loadedRequest.usageClaims[1])
+	}
+}
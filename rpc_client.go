@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/pkg/errors"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+
+	// renewedClientCloseDelay is how long a renewed RPC client is kept
+	// open, so that requests that are still using it can complete.
+	renewedClientCloseDelay = time.Minute
+)
+
+type rpcConnectionState string
+
+const (
+	rpcConnectionStateConnecting rpcConnectionState = "connecting"
+	rpcConnectionStateConnected  rpcConnectionState = "connected"
+	rpcConnectionStateClosed     rpcConnectionState = "closed"
+)
+
+// rpcConnection is a long-lived connection to kaspad that is shared
+// by all requests. Whenever the connection is lost it reconnects in
+// the background with an exponential backoff.
+type rpcConnection struct {
+	address     string
+	onConnected func(client *rpcclient.RPCClient)
+
+	lock   sync.RWMutex
+	client *rpcclient.RPCClient
+	state  rpcConnectionState
+}
+
+var faucetRPCConnection *rpcConnection
+
+// newRPCConnection returns an rpcConnection to the given address and
+// starts connecting to it in the background. onConnected is called
+// with the new client every time a connection is established.
+func newRPCConnection(address string, onConnected func(client *rpcclient.RPCClient)) *rpcConnection {
+	connection := &rpcConnection{
+		address:     address,
+		onConnected: onConnected,
+		state:       rpcConnectionStateConnecting,
+	}
+	spawn("newRPCConnection-connectLoop", connection.connectLoop)
+	return connection
+}
+
+// connectedClient returns the RPC client if it's currently connected,
+// or a HandlerError with http.StatusServiceUnavailable otherwise.
+func (c *rpcConnection) connectedClient() (*rpcclient.RPCClient, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.state != rpcConnectionStateConnected {
+		return nil, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusServiceUnavailable,
+			errors.Errorf("RPC connection to %s is %s", c.address, c.state),
+			"The faucet is temporarily unable to reach the Kaspa node. Please try again later")
+	}
+	return c.client, nil
+}
+
+// connectionState returns the current state of the connection.
+func (c *rpcConnection) connectionState() rpcConnectionState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.state
+}
+
+// close closes the connection and stops it from reconnecting.
+func (c *rpcConnection) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == rpcConnectionStateConnected {
+		err := c.client.Close()
+		if err != nil {
+			log.Warnf("Error closing the RPC client: %s", err)
+		}
+	}
+	c.client = nil
+	c.state = rpcConnectionStateClosed
+}
+
+func (c *rpcConnection) connectLoop() {
+	delay := minReconnectDelay
+	for {
+		client, err := rpcclient.NewRPCClient(c.address)
+		if err == nil {
+			if c.setConnected(client) {
+				log.Infof("RPC connection to %s is established", c.address)
+				c.onConnected(client)
+			}
+			return
+		}
+
+		if c.connectionState() == rpcConnectionStateClosed {
+			return
+		}
+		log.Warnf("Could not connect to %s: %s. Retrying in %s", c.address, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// setConnected makes the given client the current one. It returns
+// false if the connection had been closed in the meantime.
+func (c *rpcConnection) setConnected(client *rpcclient.RPCClient) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == rpcConnectionStateClosed {
+		err := client.Close()
+		if err != nil {
+			log.Warnf("Error closing the RPC client: %s", err)
+		}
+		return false
+	}
+
+	c.setDisconnectionHandlers(client)
+	c.client = client
+	c.state = rpcConnectionStateConnected
+	return true
+}
+
+// setDisconnectionHandlers replaces the RPC client's built-in
+// reconnection logic, which retries forever while blocking, with our own.
+func (c *rpcConnection) setDisconnectionHandlers(client *rpcclient.RPCClient) {
+	client.SetOnDisconnectedHandler(func() {
+		c.handleDisconnected(client)
+	})
+	client.SetOnErrorHandler(func(err error) {
+		log.Warnf("Received error from the RPC client: %s", err)
+		c.handleDisconnected(client)
+	})
+}
+
+// isCurrentClient returns whether the given client is the connected one.
+func (c *rpcConnection) isCurrentClient(client *rpcclient.RPCClient) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.client == client
+}
+
+// renew replaces the connected RPC client with a new one, and calls
+// onConnected with it. The previous client is closed after
+// renewedClientCloseDelay. It does nothing if the connection isn't
+// connected, since onConnected is called once it reconnects anyway.
+func (c *rpcConnection) renew() error {
+	if c.connectionState() != rpcConnectionStateConnected {
+		return nil
+	}
+	client, err := rpcclient.NewRPCClient(c.address)
+	if err != nil {
+		return err
+	}
+	previousClient, ok := c.replaceClient(client)
+	if !ok {
+		err := client.Close()
+		if err != nil {
+			log.Warnf("Error closing the RPC client: %s", err)
+		}
+		return nil
+	}
+	log.Infof("RPC connection to %s is renewed", c.address)
+	c.onConnected(client)
+
+	spawn("rpcConnection.renew-closePreviousClient", func() {
+		time.Sleep(renewedClientCloseDelay)
+		err := previousClient.Close()
+		if err != nil {
+			log.Warnf("Error closing the RPC client: %s", err)
+		}
+	})
+	return nil
+}
+
+// replaceClient makes the given client the current one, and returns
+// the client it replaced. It returns false if the connection isn't
+// connected.
+func (c *rpcConnection) replaceClient(client *rpcclient.RPCClient) (*rpcclient.RPCClient, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != rpcConnectionStateConnected {
+		return nil, false
+	}
+	previousClient := c.client
+	c.setDisconnectionHandlers(client)
+	c.client = client
+	return previousClient, true
+}
+
+func (c *rpcConnection) handleDisconnected(client *rpcclient.RPCClient) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Both the send and receive loops of a client report its
+	// disconnection, so make sure to only handle it once.
+	if c.client != client || c.state != rpcConnectionStateConnected {
+		return
+	}
+
+	err := client.Close()
+	if err != nil {
+		log.Warnf("Error closing the RPC client: %s", err)
+	}
+	c.client = nil
+	c.state = rpcConnectionStateConnecting
+	log.Warnf("RPC connection to %s was lost. Reconnecting", c.address)
+	spawn("rpcConnection.handleDisconnected-connectLoop", c.connectLoop)
+}
@@ -28,6 +28,18 @@ func startHTTPServer(listenAddr string) func() {
 		"/request_money",
 		httpserverutils.MakeHandler(requestMoneyHandler)).
 		Methods("GET")
+	router.HandleFunc(
+		"/request_money",
+		httpserverutils.MakeHandler(requestMoneyAsyncHandler)).
+		Methods("POST")
+	router.HandleFunc(
+		"/requests/{id}",
+		httpserverutils.MakeHandler(getPayoutRequestHandler)).
+		Methods("GET")
+	router.HandleFunc(
+		"/status",
+		httpserverutils.MakeHandler(statusHandler)).
+		Methods("GET")
 	httpServer := &http.Server{
 		Addr:    listenAddr,
 		Handler: handlers.CORS()(router),
@@ -46,13 +58,84 @@ func startHTTPServer(listenAddr string) func() {
 	}
 }
 
+type requestMoneyResponse struct {
+	RequestID     string `json:"requestId"`
+	TransactionID string `json:"transactionId,omitempty"`
+	AmountSompi   uint64 `json:"amountSompi,omitempty"`
+}
+
+// requestMoneyHandler pays the requested address. If batching is enabled
+// the request is only queued, and the caller gets back its request ID.
 func requestMoneyHandler(_ *httpserverutils.ServerContext, request *http.Request,
 	_ map[string]string, queryParams map[string]string, _ []byte) (interface{}, error) {
 
-	hErr := validateIPUsage(request)
-	if hErr != nil {
-		return nil, hErr
+	faucetRequest, err := createPayoutRequest(request, queryParams)
+	if err != nil {
+		return nil, err
+	}
+	if batcher != nil {
+		batcher.enqueue(faucetRequest)
+		return &requestMoneyResponse{RequestID: faucetRequest.id}, nil
+	}
+
+	client, err := faucetRPCConnection.connectedClient()
+	if err != nil {
+		failPayoutRequests([]*payoutRequest{faucetRequest}, err)
+		return nil, err
+	}
+	err = processPayoutRequests(client, []*payoutRequest{faucetRequest})
+	if err != nil {
+		var hErr *httpserverutils.HandlerError
+		if errors.As(err, &hErr) {
+			return nil, err
+		}
+		return nil, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
+			errors.Wrap(err, "Error sending to address"),
+			fmt.Sprintf("Error sending Kaspa: %s", err))
+	}
+	return &requestMoneyResponse{
+		RequestID:     faucetRequest.id,
+		TransactionID: faucetRequest.transactionID,
+		AmountSompi:   faucetRequest.amount,
+	}, nil
+}
+
+// requestMoneyAsyncHandler creates a payout request and returns its ID
+// right away with http.StatusAccepted. The request is paid in the
+// background, and its state can be queried with getPayoutRequestHandler.
+func requestMoneyAsyncHandler(_ *httpserverutils.ServerContext, request *http.Request,
+	_ map[string]string, queryParams map[string]string, _ []byte) (interface{}, error) {
+
+	faucetRequest, err := createPayoutRequest(request, queryParams)
+	if err != nil {
+		return nil, err
+	}
+	if batcher != nil {
+		batcher.enqueue(faucetRequest)
+	} else {
+		spawn("requestMoneyAsyncHandler-processPayoutRequests", func() {
+			client, err := faucetRPCConnection.connectedClient()
+			if err != nil {
+				failPayoutRequests([]*payoutRequest{faucetRequest}, err)
+				return
+			}
+			err = processPayoutRequests(client, []*payoutRequest{faucetRequest})
+			if err != nil {
+				log.Errorf("Error processing payout request %s: %s", faucetRequest.id, err)
+			}
+		})
 	}
+	return &httpserverutils.ResponseWithStatusCode{
+		StatusCode: http.StatusAccepted,
+		Body:       &requestMoneyResponse{RequestID: faucetRequest.id},
+	}, nil
+}
+
+// createPayoutRequest validates the request and stores a new
+// payout request for it. The rate limit slot of the IP is claimed
+// right away, so that the same IP can't queue more requests than
+// allowed. The claim is rolled back if the payout fails.
+func createPayoutRequest(request *http.Request, queryParams map[string]string) (*payoutRequest, error) {
 	addressString, ok := queryParams["address"]
 	if !ok {
 		return nil, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
@@ -65,15 +148,112 @@ func requestMoneyHandler(_ *httpserverutils.ServerContext, request *http.Request
 			errors.Wrap(err, "Error decoding address"),
 			"Error decoding address")
 	}
-	transactionID, err := sendToAddress(address)
+	requestedAmount, err := payout.requestedAmount(queryParams)
 	if err != nil {
-		return nil, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusUnprocessableEntity,
-			errors.Wrap(err, "Error sending to address"),
-			fmt.Sprintf("Error sending Kaspa: %s", err))
+		return nil, err
 	}
-	hErr = updateIPUsage(request)
-	if hErr != nil {
-		return nil, hErr
+	ip, err := ipFromRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := claimUsage(ip, address, requestedAmount)
+	if err != nil {
+		return nil, err
+	}
+	faucetRequest, err := payoutRequests.add(address, requestedAmount, ip, claims)
+	if err != nil {
+		rollbackUsageClaims(claims)
+		return nil, err
+	}
+	return faucetRequest, nil
+}
+
+// claimUsage claims the rate limit slots of the given IP and, unless the
+// address limit is disabled, of the given recipient address.
+func claimUsage(ip string, address util.Address, amountSompi uint64) ([]usageClaim, error) {
+	cfg, err := config.MainConfig()
+	if err != nil {
+		return nil, err
+	}
+	ipClaim, err := claimIPUsage(ip, amountSompi)
+	if err != nil {
+		return nil, err
+	}
+	claims := []usageClaim{ipClaim}
+	if cfg.AddressRequestInterval > 0 {
+		addressClaim, err := claimAddressUsage(address.EncodeAddress(), amountSompi, cfg.AddressRequestInterval)
+		if err != nil {
+			rollbackUsageClaims(claims)
+			return nil, err
+		}
+		claims = append(claims, addressClaim)
+	}
+	return claims, nil
+}
+
+type payoutRequestResponse struct {
+	RequestID     string             `json:"requestId"`
+	State         payoutRequestState `json:"state"`
+	TransactionID string             `json:"transactionId,omitempty"`
+	AmountSompi   uint64             `json:"amountSompi,omitempty"`
+	Error         string             `json:"error,omitempty"`
+}
+
+func getPayoutRequestHandler(_ *httpserverutils.ServerContext, _ *http.Request,
+	routeParams map[string]string, _ map[string]string, _ []byte) (interface{}, error) {
+
+	id := routeParams["id"]
+	payoutRequest, ok, err := payoutRequests.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, httpserverutils.NewHandlerError(http.StatusNotFound,
+			errors.Errorf("payout request %s was not found", id))
+	}
+	response := &payoutRequestResponse{
+		RequestID:     payoutRequest.id,
+		State:         payoutRequest.state,
+		TransactionID: payoutRequest.transactionID,
+		AmountSompi:   payoutRequest.amount,
+	}
+	if payoutRequest.err != nil {
+		response.Error = payoutRequest.err.Error()
+	}
+	return response, nil
+}
+
+type statusResponse struct {
+	RPCConnectionState        rpcConnectionState `json:"rpcConnectionState"`
+	Address                   string             `json:"address"`
+	WalletSynced              bool               `json:"walletSynced"`
+	TotalBalanceSompi         uint64             `json:"totalBalanceSompi"`
+	SpendableBalanceSompi     uint64             `json:"spendableBalanceSompi"`
+	ReservedAmountSompi       uint64             `json:"reservedAmountSompi"`
+	UTXOCount                 int                `json:"utxoCount"`
+	PayoutsLast24Hours        int                `json:"payoutsLast24Hours"`
+	EstimatedPayoutsRemaining uint64             `json:"estimatedPayoutsRemaining"`
+}
+
+// statusHandler reports the state of the faucet and its funds. The
+// estimated number of remaining payouts assumes the default amount.
+func statusHandler(_ *httpserverutils.ServerContext, _ *http.Request,
+	_ map[string]string, _ map[string]string, _ []byte) (interface{}, error) {
+
+	payoutsLast24Hours, err := recentPayoutCount(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		return nil, err
 	}
-	return transactionID, nil
+	balance := faucetWallet.balance()
+	return &statusResponse{
+		RPCConnectionState:        faucetRPCConnection.connectionState(),
+		Address:                   faucetAddress.EncodeAddress(),
+		WalletSynced:              balance.isSynced,
+		TotalBalanceSompi:         balance.total,
+		SpendableBalanceSompi:     balance.spendable,
+		ReservedAmountSompi:       balance.reserved,
+		UTXOCount:                 balance.utxoCount,
+		PayoutsLast24Hours:        payoutsLast24Hours,
+		EstimatedPayoutsRemaining: balance.spendable / payout.defaultAmount,
+	}, nil
 }
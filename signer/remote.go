@@ -0,0 +1,136 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/pkg/errors"
+)
+
+// remoteSignerTimeout is how long a RemoteSigner waits for a response.
+const remoteSignerTimeout = 30 * time.Second
+
+// The paths of the signer's HTTP API. Since it's only served over a Unix
+// socket, the host part of the URLs is ignored.
+const (
+	accountURL = "http://signer/account"
+	signURL    = "http://signer/sign"
+)
+
+type signRequest struct {
+	Transaction *appmessage.RPCTransaction `json:"transaction"`
+
+	// UTXOEntries are the entries of the outputs that the transaction
+	// spends, in the order of its inputs. The signer needs them to
+	// calculate the sighashes.
+	UTXOEntries []*appmessage.RPCUTXOEntry `json:"utxoEntries"`
+	Inputs      []*Input                   `json:"inputs"`
+}
+
+type signResponse struct {
+	Signatures []string `json:"signatures"`
+}
+
+// RemoteSigner is a Signer that asks a signer process, such as the one
+// served by Serve, to sign over a Unix socket.
+type RemoteSigner struct {
+	client *http.Client
+}
+
+// NewRemoteSigner returns a RemoteSigner that talks to the signer
+// listening on the given Unix socket.
+func NewRemoteSigner(socketPath string) *RemoteSigner {
+	dialer := &net.Dialer{}
+	return &RemoteSigner{
+		client: &http.Client{
+			Timeout: remoteSignerTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Account implements Signer.
+func (s *RemoteSigner) Account() (*Account, error) {
+	account := &Account{}
+	err := s.post(accountURL, nil, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// Sign implements Signer.
+func (s *RemoteSigner) Sign(transaction *externalapi.DomainTransaction, inputs []*Input) ([][]byte, error) {
+	request := &signRequest{
+		Transaction: appmessage.DomainTransactionToRPCTransaction(transaction),
+		UTXOEntries: make([]*appmessage.RPCUTXOEntry, len(transaction.Inputs)),
+		Inputs:      inputs,
+	}
+	for i, input := range transaction.Inputs {
+		if input.UTXOEntry == nil {
+			return nil, errors.Errorf("input %d is missing its UTXO entry", i)
+		}
+		request.UTXOEntries[i] = &appmessage.RPCUTXOEntry{
+			Amount: input.UTXOEntry.Amount(),
+			ScriptPublicKey: &appmessage.RPCScriptPublicKey{
+				Version: input.UTXOEntry.ScriptPublicKey().Version,
+				Script:  hex.EncodeToString(input.UTXOEntry.ScriptPublicKey().Script),
+			},
+			BlockDAAScore: input.UTXOEntry.BlockDAAScore(),
+			IsCoinbase:    input.UTXOEntry.IsCoinbase(),
+		}
+	}
+
+	response := &signResponse{}
+	err := s.post(signURL, request, response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Signatures) != len(inputs) {
+		return nil, errors.Errorf("the signer returned %d signatures for %d inputs",
+			len(response.Signatures), len(inputs))
+	}
+	signatures := make([][]byte, len(response.Signatures))
+	for i, signature := range response.Signatures {
+		signatures[i], err = hex.DecodeString(signature)
+		if err != nil {
+			return nil, errors.Wrap(err, "the signer returned a malformed signature")
+		}
+	}
+	return signatures, nil
+}
+
+func (s *RemoteSigner) post(url string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := s.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error connecting to the signer")
+	}
+	defer httpResponse.Body.Close()
+
+	decoder := json.NewDecoder(httpResponse.Body)
+	if httpResponse.StatusCode != http.StatusOK {
+		clientError := &httpserverutils.ClientError{}
+		err := decoder.Decode(clientError)
+		if err != nil {
+			return errors.Errorf("the signer responded with status %s", httpResponse.Status)
+		}
+		return errors.Errorf("the signer responded with an error: %s", clientError.ErrorMessage)
+	}
+	return decoder.Decode(response)
+}
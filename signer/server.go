@@ -0,0 +1,112 @@
+package signer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+// NewServer returns an HTTP server that exposes the given signer to
+// RemoteSigners.
+func NewServer(signer Signer) *http.Server {
+	router := mux.NewRouter()
+	router.Use(httpserverutils.AddRequestMetadataMiddleware)
+	router.Use(httpserverutils.RecoveryMiddleware)
+	router.Use(httpserverutils.LoggingMiddleware)
+	router.Use(httpserverutils.SetJSONMiddleware)
+	router.HandleFunc(
+		"/account",
+		httpserverutils.MakeHandler(func(_ *httpserverutils.ServerContext, _ *http.Request,
+			_ map[string]string, _ map[string]string, _ []byte) (interface{}, error) {
+
+			return signer.Account()
+		})).
+		Methods("POST")
+	router.HandleFunc(
+		"/sign",
+		httpserverutils.MakeHandler(func(_ *httpserverutils.ServerContext, _ *http.Request,
+			_ map[string]string, _ map[string]string, requestBody []byte) (interface{}, error) {
+
+			return handleSign(signer, requestBody)
+		})).
+		Methods("POST")
+	return &http.Server{Handler: router}
+}
+
+// Listen listens on a Unix socket at the given path, which only the
+// current user may connect to. The socket is created with the process
+// umask and only restricted afterwards, so its directory must not be
+// accessible to other users, or they could connect in between.
+func Listen(socketPath string) (net.Listener, error) {
+	socketDirectory := filepath.Dir(socketPath)
+	directoryInfo, err := os.Stat(socketDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if directoryInfo.Mode().Perm()&0077 != 0 {
+		return nil, errors.Errorf("the socket directory %s must only be accessible to its owner, "+
+			"but its permissions are %s", socketDirectory, directoryInfo.Mode().Perm())
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func handleSign(signer Signer, requestBody []byte) (*signResponse, error) {
+	request := &signRequest{}
+	err := json.Unmarshal(requestBody, request)
+	if err != nil {
+		return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+			errors.Wrap(err, "malformed sign request"))
+	}
+	if request.Transaction == nil {
+		return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+			errors.New("the sign request has no transaction"))
+	}
+	transaction, err := appmessage.RPCTransactionToDomainTransaction(request.Transaction)
+	if err != nil {
+		return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+			errors.Wrap(err, "malformed transaction"))
+	}
+	if len(request.UTXOEntries) != len(transaction.Inputs) {
+		return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+			errors.Errorf("got %d UTXO entries for %d inputs", len(request.UTXOEntries), len(transaction.Inputs)))
+	}
+	for i, entry := range request.UTXOEntries {
+		if entry == nil || entry.ScriptPublicKey == nil {
+			return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+				errors.Errorf("malformed UTXO entry of input %d", i))
+		}
+		transaction.Inputs[i].UTXOEntry, err = appmessage.RPCUTXOEntryToUTXOEntry(entry)
+		if err != nil {
+			return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity,
+				errors.Wrapf(err, "malformed UTXO entry of input %d", i))
+		}
+	}
+
+	signatures, err := signer.Sign(transaction, request.Inputs)
+	if err != nil {
+		return nil, httpserverutils.NewHandlerError(http.StatusUnprocessableEntity, err)
+	}
+	response := &signResponse{Signatures: make([]string, len(signatures))}
+	for i, signature := range signatures {
+		response.Signatures[i] = hex.EncodeToString(signature)
+	}
+	return response, nil
+}
@@ -0,0 +1,131 @@
+// Package signer signs the inputs of the faucet's transactions, either in
+// the faucet's process or in a separate signer process that the faucet
+// talks to over a Unix socket.
+package signer
+
+import (
+	"encoding/hex"
+
+	"github.com/kaspanet/go-secp256k1"
+	"github.com/kaspanet/kaspad/cmd/kaspawallet/libkaspawallet/bip32"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/consensushashing"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/pkg/errors"
+)
+
+// Signer signs the inputs of transactions with keys that the faucet
+// itself doesn't need to hold.
+type Signer interface {
+	// Account returns the public keys the signer signs with.
+	Account() (*Account, error)
+
+	// Sign returns the signatures of the given inputs of the transaction,
+	// in the same order. Every signature is a Schnorr signature of the
+	// input's SigHashAll sighash with the sighash type appended, as it
+	// appears in a signature script.
+	Sign(transaction *externalapi.DomainTransaction, inputs []*Input) ([][]byte, error)
+}
+
+// Account describes the keys of a signer. Exactly one of its fields is set.
+type Account struct {
+	// PublicKey is the hex of the Schnorr public key of a single-key signer.
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// ExtendedPublicKey is the extended public account key of an HD signer.
+	ExtendedPublicKey string `json:"extendedPublicKey,omitempty"`
+}
+
+// Input is a transaction input to sign.
+type Input struct {
+	Index int `json:"index"`
+
+	// DerivationPath is the path of the signing key relative to the
+	// account key, such as m/1/5. It's empty for single-key signers.
+	DerivationPath string `json:"derivationPath,omitempty"`
+}
+
+// KeySigner is a Signer that holds its private keys in memory.
+type KeySigner struct {
+	keyPair    *secp256k1.SchnorrKeyPair
+	accountKey *bip32.ExtendedKey
+}
+
+// NewSingleKeySigner returns a KeySigner that signs all inputs with
+// the given key.
+func NewSingleKeySigner(keyPair *secp256k1.SchnorrKeyPair) *KeySigner {
+	return &KeySigner{keyPair: keyPair}
+}
+
+// NewHDKeySigner returns a KeySigner that signs every input with the
+// key derived from the given extended private account key at the
+// input's derivation path.
+func NewHDKeySigner(accountKey *bip32.ExtendedKey) (*KeySigner, error) {
+	if !accountKey.IsPrivate() {
+		return nil, errors.New("the extended key is not a private key")
+	}
+	return &KeySigner{accountKey: accountKey}, nil
+}
+
+// Account implements Signer.
+func (s *KeySigner) Account() (*Account, error) {
+	if s.accountKey != nil {
+		extendedPublicKey, err := s.accountKey.Public()
+		if err != nil {
+			return nil, err
+		}
+		return &Account{ExtendedPublicKey: extendedPublicKey.String()}, nil
+	}
+
+	publicKey, err := s.keyPair.SchnorrPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	serializedPublicKey, err := publicKey.Serialize()
+	if err != nil {
+		return nil, err
+	}
+	return &Account{PublicKey: hex.EncodeToString(serializedPublicKey[:])}, nil
+}
+
+// Sign implements Signer.
+func (s *KeySigner) Sign(transaction *externalapi.DomainTransaction, inputs []*Input) ([][]byte, error) {
+	sighashReusedValues := &consensushashing.SighashReusedValues{}
+	signatures := make([][]byte, len(inputs))
+	for i, input := range inputs {
+		if input.Index < 0 || input.Index >= len(transaction.Inputs) {
+			return nil, errors.Errorf("input index %d is out of range", input.Index)
+		}
+		if transaction.Inputs[input.Index].UTXOEntry == nil {
+			return nil, errors.Errorf("input %d is missing its UTXO entry", input.Index)
+		}
+		keyPair, err := s.keyPairAt(input.DerivationPath)
+		if err != nil {
+			return nil, err
+		}
+		signatures[i], err = txscript.RawTxInSignature(
+			transaction, input.Index, consensushashing.SigHashAll, keyPair, sighashReusedValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signatures, nil
+}
+
+func (s *KeySigner) keyPairAt(derivationPath string) (*secp256k1.SchnorrKeyPair, error) {
+	if s.accountKey == nil {
+		if derivationPath != "" {
+			return nil, errors.New("a single-key signer can't derive keys")
+		}
+		return s.keyPair, nil
+	}
+
+	if derivationPath == "" {
+		return nil, errors.New("a derivation path is required to sign with an HD signer")
+	}
+	derivedKey, err := s.accountKey.DeriveFromPath(derivationPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to derive the key at %s", derivationPath)
+	}
+	return derivedKey.PrivateKey().ToSchnorr()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/signer"
+	"github.com/kaspanet/kaspad/infrastructure/os/signal"
+	"github.com/pkg/errors"
+)
+
+// signerCommand is the subcommand that runs a signer process, which holds
+// the faucet's keys and signs its transactions for a faucet started with
+// --signer-socket. It's a reference implementation: a hardened signer
+// may implement the same API with stricter checks.
+const signerCommand = "signer"
+
+// runSigner serves the key of a key file on a Unix socket until it's
+// interrupted.
+func runSigner(args []string) error {
+	interrupt := signal.InterruptListener()
+
+	signerConfig, err := config.ParseSigner(args)
+	if err != nil {
+		return err
+	}
+	accountKey, err := loadKeyfile(&signerConfig.KeyfileFlags)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load the key file %s", signerConfig.Keyfile)
+	}
+	keySigner, err := signer.NewHDKeySigner(accountKey)
+	if err != nil {
+		return err
+	}
+
+	listener, err := signer.Listen(signerConfig.Socket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", signerConfig.Socket)
+	}
+	server := signer.NewServer(keySigner)
+	spawn("runSigner-server.Serve", func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("%s", err)
+		}
+	})
+	log.Infof("Signing on %s", signerConfig.Socket)
+
+	<-interrupt
+	return server.Close()
+}
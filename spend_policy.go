@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+// spendPolicy decides when the faucet's UTXOs may be spent, and when
+// its transactions are considered confirmed.
+type spendPolicy struct {
+	confirmations    uint64
+	coinbaseMaturity uint64
+	excludeCoinbase  bool
+
+	// useDAAScore makes UTXOs mature by the virtual DAA score, which is
+	// what their block DAA score is comparable with. Otherwise they
+	// mature by the virtual selected parent blue score.
+	useDAAScore bool
+}
+
+var utxoSpendPolicy *spendPolicy
+
+func newSpendPolicy(cfg *config.Config) *spendPolicy {
+	return &spendPolicy{
+		confirmations:    *cfg.Confirmations,
+		coinbaseMaturity: config.ActiveNetParams().BlockCoinbaseMaturity,
+		excludeCoinbase:  cfg.CoinbaseSpending == "exclude",
+		useDAAScore:      cfg.SpendScore == "daa",
+	}
+}
+
+// isUTXOSpendable returns whether the given UTXO is mature enough to be
+// spent, given the current virtual DAA score and virtual selected parent
+// blue score.
+func (p *spendPolicy) isUTXOSpendable(entry *appmessage.UTXOsByAddressesEntry,
+	virtualDAAScore uint64, virtualSelectedParentBlueScore uint64) bool {
+
+	virtualScore := virtualSelectedParentBlueScore
+	if p.useDAAScore {
+		virtualScore = virtualDAAScore
+	}
+	blockDAAScore := entry.UTXOEntry.BlockDAAScore
+	if !entry.UTXOEntry.IsCoinbase {
+		return blockDAAScore+p.confirmations < virtualScore
+	}
+	if p.excludeCoinbase {
+		return false
+	}
+	requiredDepth := p.coinbaseMaturity
+	if p.confirmations > requiredDepth {
+		requiredDepth = p.confirmations
+	}
+	return blockDAAScore+requiredDepth < virtualScore
+}
+
+// isConfirmed returns whether a transaction that was accepted at the
+// given blue score has enough confirmations.
+func (p *spendPolicy) isConfirmed(acceptedBlueScore uint64, virtualSelectedParentBlueScore uint64) bool {
+	return acceptedBlueScore+p.confirmations <= virtualSelectedParentBlueScore
+}
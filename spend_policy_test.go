@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+func TestIsUTXOSpendable(t *testing.T) {
+	const (
+		blockDAAScore    = 1000
+		confirmations    = 10
+		coinbaseMaturity = 100
+	)
+	tests := []struct {
+		name                           string
+		isCoinbase                     bool
+		excludeCoinbase                bool
+		useDAAScore                    bool
+		virtualDAAScore                uint64
+		virtualSelectedParentBlueScore uint64
+		expectedSpendable              bool
+	}{
+		{
+			name:              "non-coinbase with exactly the required confirmations by DAA score",
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + confirmations,
+			expectedSpendable: false,
+		},
+		{
+			name:              "non-coinbase past the required confirmations by DAA score",
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + confirmations + 1,
+			expectedSpendable: true,
+		},
+		{
+			name:                           "non-coinbase is counted by DAA score",
+			useDAAScore:                    true,
+			virtualDAAScore:                blockDAAScore,
+			virtualSelectedParentBlueScore: blockDAAScore + confirmations + 1,
+			expectedSpendable:              false,
+		},
+		{
+			name:                           "non-coinbase past the required confirmations by blue score",
+			virtualDAAScore:                blockDAAScore,
+			virtualSelectedParentBlueScore: blockDAAScore + confirmations + 1,
+			expectedSpendable:              true,
+		},
+		{
+			name:                           "non-coinbase with exactly the required confirmations by blue score",
+			virtualDAAScore:                blockDAAScore + confirmations + 1,
+			virtualSelectedParentBlueScore: blockDAAScore + confirmations,
+			expectedSpendable:              false,
+		},
+		{
+			name:              "immature coinbase by DAA score",
+			isCoinbase:        true,
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + coinbaseMaturity,
+			expectedSpendable: false,
+		},
+		{
+			name:              "mature coinbase by DAA score",
+			isCoinbase:        true,
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + coinbaseMaturity + 1,
+			expectedSpendable: true,
+		},
+		{
+			name:                           "immature coinbase by blue score",
+			isCoinbase:                     true,
+			virtualDAAScore:                blockDAAScore + coinbaseMaturity + 1,
+			virtualSelectedParentBlueScore: blockDAAScore + coinbaseMaturity,
+			expectedSpendable:              false,
+		},
+		{
+			name:                           "mature coinbase by blue score",
+			isCoinbase:                     true,
+			virtualSelectedParentBlueScore: blockDAAScore + coinbaseMaturity + 1,
+			expectedSpendable:              true,
+		},
+		{
+			name:              "excluded mature coinbase",
+			isCoinbase:        true,
+			excludeCoinbase:   true,
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + coinbaseMaturity + 1,
+			expectedSpendable: false,
+		},
+		{
+			name:              "excluded coinbase doesn't affect non-coinbase",
+			excludeCoinbase:   true,
+			useDAAScore:       true,
+			virtualDAAScore:   blockDAAScore + confirmations + 1,
+			expectedSpendable: true,
+		},
+	}
+
+	for _, test := range tests {
+		policy := &spendPolicy{
+			confirmations:    confirmations,
+			coinbaseMaturity: coinbaseMaturity,
+			excludeCoinbase:  test.excludeCoinbase,
+			useDAAScore:      test.useDAAScore,
+		}
+		entry := &appmessage.UTXOsByAddressesEntry{
+			UTXOEntry: &appmessage.RPCUTXOEntry{BlockDAAScore: blockDAAScore, IsCoinbase: test.isCoinbase},
+		}
+		spendable := policy.isUTXOSpendable(entry, test.virtualDAAScore, test.virtualSelectedParentBlueScore)
+		if spendable != test.expectedSpendable {
+			t.Errorf("%s: expected spendable to be %t, got %t", test.name, test.expectedSpendable, spendable)
+		}
+	}
+}
+
+func TestIsUTXOSpendableWithConfirmationsAboveCoinbaseMaturity(t *testing.T) {
+	policy := &spendPolicy{confirmations: 200, coinbaseMaturity: 100, useDAAScore: true}
+	entry := &appmessage.UTXOsByAddressesEntry{
+		UTXOEntry: &appmessage.RPCUTXOEntry{BlockDAAScore: 1000, IsCoinbase: true},
+	}
+	if policy.isUTXOSpendable(entry, 1101, 0) {
+		t.Errorf("a coinbase UTXO was spendable before it had the required confirmations")
+	}
+	if !policy.isUTXOSpendable(entry, 1201, 0) {
+		t.Errorf("a coinbase UTXO wasn't spendable after it had the required confirmations")
+	}
+}
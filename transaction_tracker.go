@@ -0,0 +1,452 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kaspanet/faucet/config"
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+	"github.com/kaspanet/kaspad/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// transactionPollInterval is the interval between checks for
+	// dropped transactions.
+	transactionPollInterval = 30 * time.Second
+
+	// transactionDropTimeout is how long a submitted transaction may
+	// be neither accepted nor in the mempool before it's considered
+	// dropped.
+	transactionDropTimeout = 2 * time.Minute
+
+	// maxTransactionAttempts is how many times the same payments are
+	// submitted, successfully or not, before they're considered failed.
+	maxTransactionAttempts = 3
+)
+
+// errTransactionDropped is the error of payout requests whose
+// transaction was dropped.
+var errTransactionDropped = errors.New("the transaction was dropped from the mempool")
+
+// trackedTransaction is a submitted faucet transaction that
+// isn't confirmed yet.
+type trackedTransaction struct {
+	id                string
+	inputs            []appmessage.RPCOutpoint
+	payments          []*transactionPayment
+	attempt           int
+	submitTime        time.Time
+	isAccepted        bool
+	acceptedBlueScore uint64
+
+	// ownAddresses are the faucet's addresses that the transaction pays,
+	// such as its change address. They're not stored, so they're unknown
+	// for transactions that were loaded from the database.
+	ownAddresses         []string
+	areOwnAddressesKnown bool
+}
+
+// transactionTracker follows submitted transactions until they're
+// confirmed or dropped, and persists their status in the database.
+// A transaction is considered accepted once its inputs are reported
+// spent, and confirmed once it has as many confirmations as the spend
+// policy requires. The payments of dropped transactions are resubmitted up
+// to maxTransactionAttempts times.
+type transactionTracker struct {
+	lock                 sync.Mutex
+	transactions         map[string]*trackedTransaction
+	spendingTransactions map[appmessage.RPCOutpoint]*trackedTransaction
+
+	// unrecoveredTransactions are dropped transactions whose payments
+	// failed to be resubmitted, and are retried on the next check.
+	unrecoveredTransactions []*trackedTransaction
+}
+
+var submittedTransactions = &transactionTracker{
+	transactions:         make(map[string]*trackedTransaction),
+	spendingTransactions: make(map[appmessage.RPCOutpoint]*trackedTransaction),
+}
+
+// track stores the given submitted transaction and starts tracking it.
+func (t *transactionTracker) track(transactionID string, domainTransaction *externalapi.DomainTransaction,
+	payments []*payment, attempt int) {
+
+	transaction := &trackedTransaction{
+		id:                   transactionID,
+		inputs:               make([]appmessage.RPCOutpoint, len(domainTransaction.Inputs)),
+		payments:             make([]*transactionPayment, len(payments)),
+		attempt:              attempt,
+		submitTime:           time.Now(),
+		areOwnAddressesKnown: true,
+	}
+	inputStrings := make([]string, len(domainTransaction.Inputs))
+	totalIn := uint64(0)
+	for i, input := range domainTransaction.Inputs {
+		transaction.inputs[i] = inputOutpoint(input)
+		inputStrings[i] = outpointToString(transaction.inputs[i])
+		totalIn += input.UTXOEntry.Amount()
+	}
+	totalOut := uint64(0)
+	for _, output := range domainTransaction.Outputs {
+		totalOut += output.Value
+		if address, ok := faucetKeys.ownAddress(output.ScriptPublicKey); ok {
+			transaction.ownAddresses = append(transaction.ownAddresses, address)
+		}
+	}
+	for i, payment := range payments {
+		transaction.payments[i] = &transactionPayment{
+			Address: payment.address.EncodeAddress(),
+			Amount:  payment.amount,
+			IP:      payment.ip,
+		}
+		transaction.payments[i].IPRequestID, transaction.payments[i].AddressClaimTime =
+			usageClaimKeys(payment.usageClaims)
+	}
+
+	faucetWallet.addUnconfirmedTransaction(transactionID, domainTransaction)
+
+	err := insertTransaction(&faucetTransaction{
+		TransactionID: transactionID,
+		Payments:      transaction.payments,
+		Fee:           totalIn - totalOut,
+		Inputs:        inputStrings,
+		SubmitTime:    transaction.submitTime,
+		Status:        transactionStatusSubmitted,
+		Attempt:       attempt,
+	})
+	if err != nil {
+		log.Errorf("Error storing transaction %s: %s", transactionID, err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.add(transaction)
+}
+
+// load starts tracking the pending transactions stored in the database,
+// and reserves their inputs so that they aren't spent again. The graph of
+// unconfirmed transactions isn't persisted, so their outputs are only
+// spent again once they're in the wallet's UTXO set.
+func (t *transactionTracker) load() error {
+	transactions, err := pendingTransactions()
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, storedTransaction := range transactions {
+		transaction := &trackedTransaction{
+			id:                storedTransaction.TransactionID,
+			inputs:            make([]appmessage.RPCOutpoint, len(storedTransaction.Inputs)),
+			payments:          storedTransaction.Payments,
+			attempt:           storedTransaction.Attempt,
+			submitTime:        storedTransaction.SubmitTime,
+			isAccepted:        storedTransaction.Status == transactionStatusAccepted,
+			acceptedBlueScore: storedTransaction.AcceptedBlueScore,
+		}
+		for i, inputString := range storedTransaction.Inputs {
+			transaction.inputs[i], err = outpointFromString(inputString)
+			if err != nil {
+				return err
+			}
+		}
+		t.add(transaction)
+		if !transaction.isAccepted {
+			faucetWallet.reserveOutpoints(transaction.inputs)
+		}
+	}
+	log.Infof("Loaded %d pending transactions", len(transactions))
+	return nil
+}
+
+// add must be called with the lock held.
+func (t *transactionTracker) add(transaction *trackedTransaction) {
+	t.transactions[transaction.id] = transaction
+	if transaction.isAccepted {
+		return
+	}
+	for _, input := range transaction.inputs {
+		t.spendingTransactions[input] = transaction
+	}
+}
+
+// handleSpentUTXOs marks the transactions that spend the given
+// UTXOs as accepted.
+func (t *transactionTracker) handleSpentUTXOs(spentUTXOs []*appmessage.UTXOsByAddressesEntry,
+	virtualSelectedParentBlueScore uint64) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, entry := range spentUTXOs {
+		transaction, ok := t.spendingTransactions[*entry.Outpoint]
+		if !ok {
+			continue
+		}
+		t.setAccepted(transaction, virtualSelectedParentBlueScore)
+	}
+}
+
+// setAccepted must be called with the lock held.
+func (t *transactionTracker) setAccepted(transaction *trackedTransaction, virtualSelectedParentBlueScore uint64) {
+	transaction.isAccepted = true
+	transaction.acceptedBlueScore = virtualSelectedParentBlueScore
+	for _, input := range transaction.inputs {
+		delete(t.spendingTransactions, input)
+	}
+	faucetWallet.setUnconfirmedTransactionAccepted(transaction.id)
+
+	err := updateTransactionStatus(transaction.id, transactionStatusAccepted, virtualSelectedParentBlueScore)
+	if err != nil {
+		log.Errorf("Error updating the status of transaction %s: %s", transaction.id, err)
+	}
+	payoutRequests.setTransactionState(transaction.id, payoutRequestStateAccepted)
+	log.Debugf("Transaction %s was accepted", transaction.id)
+}
+
+// pendingOwnAddresses returns the faucet's addresses that the tracked
+// transactions pay, and whether they're all known.
+func (t *transactionTracker) pendingOwnAddresses() (map[string]struct{}, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	addresses := make(map[string]struct{})
+	for _, transaction := range t.transactions {
+		if !transaction.areOwnAddressesKnown {
+			return nil, false
+		}
+		for _, address := range transaction.ownAddresses {
+			addresses[address] = struct{}{}
+		}
+	}
+	return addresses, true
+}
+
+// isPending returns whether the given transaction is tracked
+// and wasn't accepted yet.
+func (t *transactionTracker) isPending(transactionID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	transaction, ok := t.transactions[transactionID]
+	return ok && !transaction.isAccepted
+}
+
+// handleVirtualSelectedParentBlueScoreChanged marks the accepted
+// transactions that have enough confirmations as confirmed, and
+// stops tracking them.
+func (t *transactionTracker) handleVirtualSelectedParentBlueScoreChanged(virtualSelectedParentBlueScore uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for transactionID, transaction := range t.transactions {
+		if !transaction.isAccepted ||
+			!utxoSpendPolicy.isConfirmed(transaction.acceptedBlueScore, virtualSelectedParentBlueScore) {
+			continue
+		}
+		delete(t.transactions, transactionID)
+		faucetWallet.removeUnconfirmedTransaction(transactionID)
+
+		err := updateTransactionStatus(transactionID, transactionStatusConfirmed, transaction.acceptedBlueScore)
+		if err != nil {
+			log.Errorf("Error updating the status of transaction %s: %s", transactionID, err)
+		}
+		payoutRequests.setTransactionState(transactionID, payoutRequestStateConfirmed)
+		log.Debugf("Transaction %s was confirmed", transactionID)
+	}
+}
+
+// checkDroppedTransactions looks for transactions that were submitted a
+// while ago but were neither accepted nor are in the mempool. Those
+// transactions are considered dropped: their inputs are released and
+// their payments are recovered. Transactions that spend unconfirmed
+// outputs of dropped transactions are dropped along with them. The
+// recovery of previously dropped transactions that failed is retried.
+func (t *transactionTracker) checkDroppedTransactions(client *rpcclient.RPCClient) {
+	droppedTransactions := append(t.takeUnrecoveredTransactions(), t.collectDroppedTransactions(client)...)
+	for _, transaction := range droppedTransactions {
+		t.recoverDroppedTransaction(client, transaction)
+	}
+}
+
+func (t *transactionTracker) takeUnrecoveredTransactions() []*trackedTransaction {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	unrecoveredTransactions := t.unrecoveredTransactions
+	t.unrecoveredTransactions = nil
+	return unrecoveredTransactions
+}
+
+func (t *transactionTracker) collectDroppedTransactions(client *rpcclient.RPCClient) []*trackedTransaction {
+	// Until the wallet is synced, transactions whose inputs were already
+	// spent can't be told apart from dropped ones.
+	if !faucetWallet.synced() {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var droppedTransactions []*trackedTransaction
+	var nodeUTXOs map[appmessage.RPCOutpoint]struct{}
+	virtualSelectedParentBlueScore := faucetWallet.currentVirtualSelectedParentBlueScore()
+	for transactionID, transaction := range t.transactions {
+		if transaction.isAccepted || time.Since(transaction.submitTime) < transactionDropTimeout {
+			continue
+		}
+
+		// The UTXOs changed notification might have been missed,
+		// for example while the RPC client was reconnecting.
+		if faucetWallet.isAnyOutpointSpent(transaction.inputs) {
+			t.setAccepted(transaction, virtualSelectedParentBlueScore)
+			continue
+		}
+
+		_, err := client.GetMempoolEntry(transactionID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, rpcclient.ErrRPC) {
+			log.Warnf("Error getting the mempool entry of transaction %s: %s", transactionID, err)
+			continue
+		}
+
+		// A transaction that was already mined isn't in the mempool
+		// either, so its inputs are checked with the node itself in
+		// case the wallet missed that they were spent.
+		if nodeUTXOs == nil {
+			utxos, nodeVirtualSelectedParentBlueScore, _, err := fetchUTXOs(client)
+			if err != nil {
+				log.Warnf("Error fetching UTXOs to check for dropped transactions: %s", err)
+				return droppedTransactions
+			}
+			nodeUTXOs = make(map[appmessage.RPCOutpoint]struct{}, len(utxos))
+			for _, entry := range utxos {
+				nodeUTXOs[*entry.Outpoint] = struct{}{}
+			}
+			virtualSelectedParentBlueScore = nodeVirtualSelectedParentBlueScore
+		}
+		if faucetWallet.isAnyOutpointMissing(transaction.inputs, nodeUTXOs) {
+			t.setAccepted(transaction, virtualSelectedParentBlueScore)
+			continue
+		}
+
+		t.drop(transaction)
+		faucetWallet.releaseOutpoints(transaction.inputs)
+		droppedTransactions = append(droppedTransactions, transaction)
+
+		for _, descendantID := range faucetWallet.invalidateUnconfirmedTransaction(transactionID) {
+			descendant, ok := t.transactions[descendantID]
+			if !ok {
+				continue
+			}
+			t.drop(descendant)
+			droppedTransactions = append(droppedTransactions, descendant)
+		}
+	}
+	return droppedTransactions
+}
+
+// drop must be called with the lock held.
+func (t *transactionTracker) drop(transaction *trackedTransaction) {
+	delete(t.transactions, transaction.id)
+	for _, input := range transaction.inputs {
+		delete(t.spendingTransactions, input)
+	}
+}
+
+// recoverDroppedTransaction pays the payments of the given dropped
+// transaction again using fresh UTXOs. A failed resubmission is retried
+// on the next check, and uses up an attempt unless the faucet was only
+// temporarily unavailable. Once the payments run out of attempts they
+// are considered failed, and the rate limit slots claimed for them are
+// freed.
+func (t *transactionTracker) recoverDroppedTransaction(client *rpcclient.RPCClient, transaction *trackedTransaction) {
+	// Transactions without payments, such as consolidation
+	// transactions, have nothing to recover.
+	if len(transaction.payments) > 0 && transaction.attempt < maxTransactionAttempts {
+		replacingTransactionID, err := t.resubmitPayments(client, transaction)
+		if err == nil {
+			err = setTransactionReplaced(transaction.id, replacingTransactionID)
+			if err != nil {
+				log.Errorf("Error updating the status of transaction %s: %s", transaction.id, err)
+			}
+			payoutRequests.setTransactionReplaced(transaction.id, replacingTransactionID)
+			log.Warnf("Transaction %s was dropped and replaced by transaction %s",
+				transaction.id, replacingTransactionID)
+			return
+		}
+		if !isServiceUnavailable(err) {
+			transaction.attempt++
+		}
+		if transaction.attempt < maxTransactionAttempts {
+			log.Warnf("Error resubmitting the payments of dropped transaction %s, retrying later: %s",
+				transaction.id, err)
+			t.lock.Lock()
+			t.unrecoveredTransactions = append(t.unrecoveredTransactions, transaction)
+			t.lock.Unlock()
+			return
+		}
+		log.Errorf("Error resubmitting the payments of dropped transaction %s: %s", transaction.id, err)
+	}
+
+	err := updateTransactionStatus(transaction.id, transactionStatusDropped, 0)
+	if err != nil {
+		log.Errorf("Error updating the status of transaction %s: %s", transaction.id, err)
+	}
+	payoutRequests.setTransactionFailed(transaction.id, errTransactionDropped)
+	for _, payment := range transaction.payments {
+		rollbackUsageClaims(usageClaimsOf(payment.IPRequestID, payment.Address, payment.AddressClaimTime))
+	}
+	log.Warnf("Transaction %s was dropped and its payments failed", transaction.id)
+}
+
+func (t *transactionTracker) resubmitPayments(client *rpcclient.RPCClient, transaction *trackedTransaction) (
+	string, error) {
+
+	payments := make([]*payment, len(transaction.payments))
+	for i, transactionPayment := range transaction.payments {
+		address, err := util.DecodeAddress(transactionPayment.Address, config.ActiveNetParams().Prefix)
+		if err != nil {
+			return "", err
+		}
+		payments[i] = &payment{
+			address: address,
+			amount:  transactionPayment.Amount,
+			ip:      transactionPayment.IP,
+			usageClaims: usageClaimsOf(
+				transactionPayment.IPRequestID, transactionPayment.Address, transactionPayment.AddressClaimTime),
+		}
+	}
+	replacingTransactionID, _, err := submitPayments(client, payments, transaction.attempt+1)
+	return replacingTransactionID, err
+}
+
+// isServiceUnavailable returns whether the given error is of the faucet
+// being temporarily unavailable, such as while the RPC client is
+// disconnected or the wallet isn't synced yet.
+func isServiceUnavailable(err error) bool {
+	var handlerErr *httpserverutils.HandlerError
+	return errors.As(err, &handlerErr) && handlerErr.Code == http.StatusServiceUnavailable
+}
+
+// transactionTrackerLoop periodically checks for dropped transactions
+// while the RPC client is connected.
+func transactionTrackerLoop() {
+	for range time.Tick(transactionPollInterval) {
+		client, err := faucetRPCConnection.connectedClient()
+		if err != nil {
+			continue
+		}
+		submittedTransactions.checkDroppedTransactions(client)
+	}
+}
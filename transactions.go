@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaspanet/faucet/database"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/pkg/errors"
+)
+
+type transactionStatus string
+
+const (
+	transactionStatusSubmitted transactionStatus = "submitted"
+	transactionStatusAccepted  transactionStatus = "accepted"
+	transactionStatusConfirmed transactionStatus = "confirmed"
+	transactionStatusDropped   transactionStatus = "dropped"
+)
+
+// faucetTransaction is a transaction submitted by the faucet,
+// as stored in the transactions table.
+type faucetTransaction struct {
+	tableName struct{} `pg:"transactions"`
+
+	TransactionID     string `pg:",pk"`
+	Payments          []*transactionPayment
+	Fee               uint64   `pg:",use_zero"`
+	Inputs            []string `pg:",array"`
+	SubmitTime        time.Time
+	Status            transactionStatus
+	AcceptedBlueScore uint64 `pg:",use_zero"`
+	Attempt           int
+	ReplacedBy        string
+}
+
+// transactionPayment is a payment of a faucet transaction. IPRequestID
+// and AddressClaimTime are the keys of the rate limit slots claimed for
+// it, as returned by usageClaimKeys.
+type transactionPayment struct {
+	Address          string    `json:"address"`
+	Amount           uint64    `json:"amount"`
+	IP               string    `json:"ip"`
+	IPRequestID      int64     `json:"ipRequestId,omitempty"`
+	AddressClaimTime time.Time `json:"addressClaimTime"`
+}
+
+func insertTransaction(transaction *faucetTransaction) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(transaction).Insert()
+	return err
+}
+
+func updateTransactionStatus(transactionID string, status transactionStatus, acceptedBlueScore uint64) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&faucetTransaction{}).
+		Set("status = ?", status).
+		Set("accepted_blue_score = ?", acceptedBlueScore).
+		Where("transaction_id = ?", transactionID).
+		Update()
+	return err
+}
+
+// setTransactionReplaced marks the given transaction as dropped
+// and replaced by another transaction.
+func setTransactionReplaced(transactionID string, replacingTransactionID string) error {
+	db, err := database.DB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Model(&faucetTransaction{}).
+		Set("status = ?", transactionStatusDropped).
+		Set("replaced_by = ?", replacingTransactionID).
+		Where("transaction_id = ?", transactionID).
+		Update()
+	return err
+}
+
+// pendingTransactions returns the transactions that are not
+// confirmed nor dropped yet.
+func pendingTransactions() ([]*faucetTransaction, error) {
+	db, err := database.DB()
+	if err != nil {
+		return nil, err
+	}
+	var transactions []*faucetTransaction
+	err = db.Model(&transactions).
+		Where("status IN (?, ?)", transactionStatusSubmitted, transactionStatusAccepted).
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
+// recentPayoutCount returns the number of payments made by transactions
+// that were submitted since the given time and weren't dropped.
+func recentPayoutCount(since time.Time) (int, error) {
+	db, err := database.DB()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = db.Model(&faucetTransaction{}).
+		ColumnExpr("COALESCE(SUM(jsonb_array_length(payments)), 0)").
+		Where("submit_time >= ?", since).
+		Where("status != ?", transactionStatusDropped).
+		Select(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func outpointToString(outpoint appmessage.RPCOutpoint) string {
+	return fmt.Sprintf("%s:%d", outpoint.TransactionID, outpoint.Index)
+}
+
+func outpointFromString(outpointString string) (appmessage.RPCOutpoint, error) {
+	separatorIndex := strings.LastIndex(outpointString, ":")
+	if separatorIndex == -1 {
+		return appmessage.RPCOutpoint{}, errors.Errorf("malformed outpoint %s", outpointString)
+	}
+	index, err := strconv.ParseUint(outpointString[separatorIndex+1:], 10, 32)
+	if err != nil {
+		return appmessage.RPCOutpoint{}, errors.Wrapf(err, "malformed outpoint %s", outpointString)
+	}
+	return appmessage.RPCOutpoint{
+		TransactionID: outpointString[:separatorIndex],
+		Index:         uint32(index),
+	}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/constants"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/subnetworks"
+	"github.com/kaspanet/kaspad/domain/consensus/utils/txscript"
+	"github.com/pkg/errors"
+)
+
+// UTXOSelector selects the UTXOs that fund a transaction.
+type UTXOSelector interface {
+	// SelectUTXOs returns UTXOs out of the given ones whose total value
+	// is at least totalToSpend, along with the change left over.
+	SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+		selectedUTXOs []*appmessage.UTXOsByAddressesEntry, changeSompi uint64, err error)
+}
+
+const (
+	utxoSelectionLargestFirst   = "largest-first"
+	utxoSelectionSmallestFirst  = "smallest-first"
+	utxoSelectionBranchAndBound = "branch-and-bound"
+	utxoSelectionRandom         = "random"
+)
+
+var utxoSelector UTXOSelector
+
+// newUTXOSelector returns the UTXOSelector of the given strategy.
+// costOfChange is the fee of adding a change output to a transaction,
+// which branch-and-bound selection may give up to avoid the change.
+func newUTXOSelector(strategy string, costOfChange uint64) (UTXOSelector, error) {
+	switch strategy {
+	case utxoSelectionLargestFirst:
+		return largestFirstSelector{}, nil
+	case utxoSelectionSmallestFirst:
+		return smallestFirstSelector{}, nil
+	case utxoSelectionBranchAndBound:
+		return &branchAndBoundSelector{
+			costOfChange: costOfChange,
+			maxTries:     defaultBranchAndBoundMaxTries,
+			fallback:     largestFirstSelector{},
+		}, nil
+	case utxoSelectionRandom:
+		return &randomSelector{random: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	}
+	return nil, errors.Errorf("unknown UTXO selection strategy %s", strategy)
+}
+
+// changeOutputCost returns the fee of adding a change output
+// to a transaction at the given fee rate.
+func changeOutputCost(feeRate float64) (uint64, error) {
+	changeScript, err := txscript.PayToAddrScript(faucetAddress)
+	if err != nil {
+		return 0, err
+	}
+	domainTransaction := &externalapi.DomainTransaction{
+		Version:      constants.MaxTransactionVersion,
+		SubnetworkID: subnetworks.SubnetworkIDNative,
+	}
+	massWithoutChange := calculateTransactionMass(domainTransaction)
+	domainTransaction.Outputs = []*externalapi.DomainTransactionOutput{{ScriptPublicKey: changeScript}}
+	massWithChange := calculateTransactionMass(domainTransaction)
+	return calculateFee(massWithChange-massWithoutChange, feeRate), nil
+}
+
+// largestFirstSelector selects the largest UTXOs first,
+// which minimizes the number of inputs.
+type largestFirstSelector struct{}
+
+func (largestFirstSelector) SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	[]*appmessage.UTXOsByAddressesEntry, uint64, error) {
+
+	sortedUTXOs := sortedByAmountDescending(utxos)
+	return selectUTXOsInOrder(sortedUTXOs, totalToSpend)
+}
+
+// smallestFirstSelector selects the smallest UTXOs first,
+// which sweeps dust out of the wallet.
+type smallestFirstSelector struct{}
+
+func (smallestFirstSelector) SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	[]*appmessage.UTXOsByAddressesEntry, uint64, error) {
+
+	return selectUTXOsInOrder(sortedByAmount(utxos), totalToSpend)
+}
+
+// randomSelector selects UTXOs in a random order. It's not safe for
+// concurrent use, which is fine since UTXOs are only ever selected
+// while the wallet is locked.
+type randomSelector struct {
+	random *rand.Rand
+}
+
+func (s *randomSelector) SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	[]*appmessage.UTXOsByAddressesEntry, uint64, error) {
+
+	shuffledUTXOs := make([]*appmessage.UTXOsByAddressesEntry, len(utxos))
+	copy(shuffledUTXOs, utxos)
+	s.random.Shuffle(len(shuffledUTXOs), func(i, j int) {
+		shuffledUTXOs[i], shuffledUTXOs[j] = shuffledUTXOs[j], shuffledUTXOs[i]
+	})
+	return selectUTXOsInOrder(shuffledUTXOs, totalToSpend)
+}
+
+// defaultBranchAndBoundMaxTries bounds the search of branchAndBoundSelector.
+const defaultBranchAndBoundMaxTries = 100_000
+
+// branchAndBoundSelector searches for a set of UTXOs whose total value
+// exceeds totalToSpend by no more than the cost of a change output, so
+// that the transaction can skip the change output altogether. The excess
+// goes to the fee. If no such set is found, fallback is used instead.
+type branchAndBoundSelector struct {
+	costOfChange uint64
+	maxTries     int
+	fallback     UTXOSelector
+}
+
+func (s *branchAndBoundSelector) SelectUTXOs(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	[]*appmessage.UTXOsByAddressesEntry, uint64, error) {
+
+	sortedUTXOs := sortedByAmountDescending(utxos)
+
+	// remainingValues[i] is the total value of sortedUTXOs[i:]
+	remainingValues := make([]uint64, len(sortedUTXOs)+1)
+	for i := len(sortedUTXOs) - 1; i >= 0; i-- {
+		remainingValues[i] = remainingValues[i+1] + sortedUTXOs[i].UTXOEntry.Amount
+	}
+
+	tries := 0
+	included := make([]bool, len(sortedUTXOs))
+	var search func(index int, selectedValue uint64) bool
+	search = func(index int, selectedValue uint64) bool {
+		tries++
+		if selectedValue >= totalToSpend {
+			return selectedValue-totalToSpend <= s.costOfChange
+		}
+		if index == len(sortedUTXOs) || tries > s.maxTries ||
+			selectedValue+remainingValues[index] < totalToSpend {
+			return false
+		}
+
+		included[index] = true
+		if search(index+1, selectedValue+sortedUTXOs[index].UTXOEntry.Amount) {
+			return true
+		}
+		included[index] = false
+		return search(index+1, selectedValue)
+	}
+
+	if !search(0, 0) {
+		return s.fallback.SelectUTXOs(utxos, totalToSpend)
+	}
+
+	selectedUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0)
+	for i, utxo := range sortedUTXOs {
+		if included[i] {
+			selectedUTXOs = append(selectedUTXOs, utxo)
+		}
+	}
+	return selectedUTXOs, 0, nil
+}
+
+// sortedByAmount returns a copy of the given UTXOs sorted by amount
+// in ascending order.
+func sortedByAmount(utxos []*appmessage.UTXOsByAddressesEntry) []*appmessage.UTXOsByAddressesEntry {
+	sortedUTXOs := make([]*appmessage.UTXOsByAddressesEntry, len(utxos))
+	copy(sortedUTXOs, utxos)
+	sort.SliceStable(sortedUTXOs, func(i, j int) bool {
+		return sortedUTXOs[i].UTXOEntry.Amount < sortedUTXOs[j].UTXOEntry.Amount
+	})
+	return sortedUTXOs
+}
+
+// sortedByAmountDescending returns a copy of the given UTXOs sorted
+// by amount in descending order.
+func sortedByAmountDescending(utxos []*appmessage.UTXOsByAddressesEntry) []*appmessage.UTXOsByAddressesEntry {
+	sortedUTXOs := make([]*appmessage.UTXOsByAddressesEntry, len(utxos))
+	copy(sortedUTXOs, utxos)
+	sort.SliceStable(sortedUTXOs, func(i, j int) bool {
+		return sortedUTXOs[i].UTXOEntry.Amount > sortedUTXOs[j].UTXOEntry.Amount
+	})
+	return sortedUTXOs
+}
+
+// selectUTXOsInOrder selects UTXOs in the given order until
+// their total value covers totalToSpend.
+func selectUTXOsInOrder(utxos []*appmessage.UTXOsByAddressesEntry, totalToSpend uint64) (
+	selectedUTXOs []*appmessage.UTXOsByAddressesEntry, changeSompi uint64, err error) {
+
+	selectedUTXOs = []*appmessage.UTXOsByAddressesEntry{}
+	totalValue := uint64(0)
+
+	for _, utxo := range utxos {
+		selectedUTXOs = append(selectedUTXOs, utxo)
+		totalValue += utxo.UTXOEntry.Amount
+
+		if totalValue >= totalToSpend {
+			break
+		}
+	}
+
+	if totalValue < totalToSpend {
+		return nil, 0, errors.Errorf("Insufficient funds for send: %f required, while only %f available",
+			float64(totalToSpend)/constants.SompiPerKaspa, float64(totalValue)/constants.SompiPerKaspa)
+	}
+
+	return selectedUTXOs, totalValue - totalToSpend, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+)
+
+func utxosWithAmounts(amounts ...uint64) []*appmessage.UTXOsByAddressesEntry {
+	utxos := make([]*appmessage.UTXOsByAddressesEntry, len(amounts))
+	for i, amount := range amounts {
+		utxos[i] = &appmessage.UTXOsByAddressesEntry{
+			Outpoint:  &appmessage.RPCOutpoint{Index: uint32(i)},
+			UTXOEntry: &appmessage.RPCUTXOEntry{Amount: amount},
+		}
+	}
+	return utxos
+}
+
+func amountsOf(utxos []*appmessage.UTXOsByAddressesEntry) []uint64 {
+	amounts := make([]uint64, len(utxos))
+	for i, utxo := range utxos {
+		amounts[i] = utxo.UTXOEntry.Amount
+	}
+	return amounts
+}
+
+func TestSelectUTXOs(t *testing.T) {
+	tests := []struct {
+		name            string
+		selector        UTXOSelector
+		amounts         []uint64
+		totalToSpend    uint64
+		expectedAmounts []uint64
+		expectedChange  uint64
+		expectsError    bool
+	}{
+		{
+			name:            "largest-first exact match",
+			selector:        largestFirstSelector{},
+			amounts:         []uint64{1, 5, 3, 10},
+			totalToSpend:    15,
+			expectedAmounts: []uint64{10, 5},
+			expectedChange:  0,
+		},
+		{
+			name:            "largest-first with change",
+			selector:        largestFirstSelector{},
+			amounts:         []uint64{1, 5, 3, 10},
+			totalToSpend:    12,
+			expectedAmounts: []uint64{10, 5},
+			expectedChange:  3,
+		},
+		{
+			name:         "largest-first insufficient funds",
+			selector:     largestFirstSelector{},
+			amounts:      []uint64{1, 5, 3, 10},
+			totalToSpend: 20,
+			expectsError: true,
+		},
+		{
+			name:            "smallest-first exact match",
+			selector:        smallestFirstSelector{},
+			amounts:         []uint64{10, 3, 5, 1},
+			totalToSpend:    4,
+			expectedAmounts: []uint64{1, 3},
+			expectedChange:  0,
+		},
+		{
+			name:            "smallest-first with change",
+			selector:        smallestFirstSelector{},
+			amounts:         []uint64{10, 3, 5, 1},
+			totalToSpend:    6,
+			expectedAmounts: []uint64{1, 3, 5},
+			expectedChange:  3,
+		},
+		{
+			name:         "smallest-first insufficient funds",
+			selector:     smallestFirstSelector{},
+			amounts:      []uint64{10, 3, 5, 1},
+			totalToSpend: 20,
+			expectsError: true,
+		},
+		{
+			name:            "random exact match",
+			selector:        &randomSelector{random: rand.New(rand.NewSource(0))},
+			amounts:         []uint64{4, 4, 4, 4},
+			totalToSpend:    8,
+			expectedAmounts: []uint64{4, 4},
+			expectedChange:  0,
+		},
+		{
+			name:         "random insufficient funds",
+			selector:     &randomSelector{random: rand.New(rand.NewSource(0))},
+			amounts:      []uint64{1, 5, 3, 10},
+			totalToSpend: 20,
+			expectsError: true,
+		},
+		{
+			name:            "branch-and-bound exact match",
+			selector:        newTestBranchAndBoundSelector(1),
+			amounts:         []uint64{10, 7, 5, 3},
+			totalToSpend:    8,
+			expectedAmounts: []uint64{5, 3},
+			expectedChange:  0,
+		},
+		{
+			name:            "branch-and-bound excess within the cost of change",
+			selector:        newTestBranchAndBoundSelector(2),
+			amounts:         []uint64{3, 5, 7, 10},
+			totalToSpend:    11,
+			expectedAmounts: []uint64{10, 3},
+			expectedChange:  0,
+		},
+		{
+			name:            "branch-and-bound falls back to largest-first",
+			selector:        newTestBranchAndBoundSelector(0),
+			amounts:         []uint64{10, 7, 5, 3},
+			totalToSpend:    24,
+			expectedAmounts: []uint64{10, 7, 5, 3},
+			expectedChange:  1,
+		},
+		{
+			name:         "branch-and-bound insufficient funds",
+			selector:     newTestBranchAndBoundSelector(2),
+			amounts:      []uint64{10, 7, 5, 3},
+			totalToSpend: 30,
+			expectsError: true,
+		},
+	}
+
+	for _, test := range tests {
+		selectedUTXOs, change, err := test.selector.SelectUTXOs(utxosWithAmounts(test.amounts...), test.totalToSpend)
+		if test.expectsError {
+			if err == nil {
+				t.Errorf("%s: expected an error, got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		selectedAmounts := amountsOf(selectedUTXOs)
+		if !reflect.DeepEqual(selectedAmounts, test.expectedAmounts) {
+			t.Errorf("%s: expected amounts %v, got %v", test.name, test.expectedAmounts, selectedAmounts)
+		}
+		if change != test.expectedChange {
+			t.Errorf("%s: expected change %d, got %d", test.name, test.expectedChange, change)
+		}
+	}
+}
+
+func newTestBranchAndBoundSelector(costOfChange uint64) *branchAndBoundSelector {
+	return &branchAndBoundSelector{
+		costOfChange: costOfChange,
+		maxTries:     defaultBranchAndBoundMaxTries,
+		fallback:     largestFirstSelector{},
+	}
+}
+
+func TestRandomSelectorIsDeterministicForASeed(t *testing.T) {
+	amounts := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for seed := int64(0); seed < 10; seed++ {
+		firstSelector := &randomSelector{random: rand.New(rand.NewSource(seed))}
+		secondSelector := &randomSelector{random: rand.New(rand.NewSource(seed))}
+		firstUTXOs, firstChange, err := firstSelector.SelectUTXOs(utxosWithAmounts(amounts...), 12)
+		if err != nil {
+			t.Fatalf("seed %d: unexpected error: %s", seed, err)
+		}
+		secondUTXOs, secondChange, err := secondSelector.SelectUTXOs(utxosWithAmounts(amounts...), 12)
+		if err != nil {
+			t.Fatalf("seed %d: unexpected error: %s", seed, err)
+		}
+		if !reflect.DeepEqual(amountsOf(firstUTXOs), amountsOf(secondUTXOs)) || firstChange != secondChange {
+			t.Errorf("seed %d: selections differ: %v and %v",
+				seed, amountsOf(firstUTXOs), amountsOf(secondUTXOs))
+		}
+
+		total := uint64(0)
+		for _, amount := range amountsOf(firstUTXOs) {
+			total += amount
+		}
+		if total < 12 || total-12 != firstChange {
+			t.Errorf("seed %d: selected %d with change %d for spending 12", seed, total, firstChange)
+		}
+		if total-firstUTXOs[len(firstUTXOs)-1].UTXOEntry.Amount >= 12 {
+			t.Errorf("seed %d: selected more UTXOs than needed: %v", seed, amountsOf(firstUTXOs))
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/kaspanet/faucet/httpserverutils"
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+	"github.com/pkg/errors"
+)
+
+// wallet is an in-memory index of the faucet's UTXOs. It also keeps track
+// of the outpoints that are spent by transactions that are still in flight,
+// so that concurrent requests don't build conflicting transactions.
+type wallet struct {
+	lock                           sync.Mutex
+	isSynced                       bool
+	utxos                          map[appmessage.RPCOutpoint]*appmessage.UTXOsByAddressesEntry
+	reservedOutpoints              map[appmessage.RPCOutpoint]struct{}
+	virtualSelectedParentBlueScore uint64
+	virtualDAAScore                uint64
+
+	// chainUnconfirmedChange enables spending the outputs that the
+	// faucet pays itself before they're confirmed. See wallet_chain.go.
+	chainUnconfirmedChange  bool
+	unconfirmedTransactions map[string]*unconfirmedTransaction
+	unconfirmedUTXOs        map[appmessage.RPCOutpoint]*unconfirmedUTXO
+}
+
+var faucetWallet *wallet
+
+func newWallet(chainUnconfirmedChange bool) *wallet {
+	return &wallet{
+		utxos:                   make(map[appmessage.RPCOutpoint]*appmessage.UTXOsByAddressesEntry),
+		reservedOutpoints:       make(map[appmessage.RPCOutpoint]struct{}),
+		chainUnconfirmedChange:  chainUnconfirmedChange,
+		unconfirmedTransactions: make(map[string]*unconfirmedTransaction),
+		unconfirmedUTXOs:        make(map[appmessage.RPCOutpoint]*unconfirmedUTXO),
+	}
+}
+
+// resync replaces the wallet's UTXO set with the given one. Reserved
+// outpoints that are missing from the new set were spent, unless they're
+// unconfirmed outputs of the faucet, so their reservations are released.
+func (w *wallet) resync(utxos []*appmessage.UTXOsByAddressesEntry,
+	virtualSelectedParentBlueScore uint64, virtualDAAScore uint64) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.utxos = make(map[appmessage.RPCOutpoint]*appmessage.UTXOsByAddressesEntry, len(utxos))
+	for _, entry := range utxos {
+		w.utxos[*entry.Outpoint] = entry
+	}
+	for outpoint := range w.reservedOutpoints {
+		if _, ok := w.utxos[outpoint]; ok {
+			continue
+		}
+		if _, ok := w.unconfirmedUTXOs[outpoint]; ok {
+			continue
+		}
+		delete(w.reservedOutpoints, outpoint)
+	}
+	w.virtualSelectedParentBlueScore = virtualSelectedParentBlueScore
+	w.virtualDAAScore = virtualDAAScore
+	w.isSynced = true
+}
+
+// applyUTXOsChanged adds and removes the given UTXOs. Reservations of
+// removed UTXOs are released, since they are now spent, and so are
+// their unconfirmed counterparts.
+func (w *wallet) applyUTXOsChanged(added []*appmessage.UTXOsByAddressesEntry,
+	removed []*appmessage.UTXOsByAddressesEntry) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, entry := range removed {
+		delete(w.utxos, *entry.Outpoint)
+		delete(w.reservedOutpoints, *entry.Outpoint)
+		delete(w.unconfirmedUTXOs, *entry.Outpoint)
+	}
+	for _, entry := range added {
+		w.utxos[*entry.Outpoint] = entry
+	}
+}
+
+func (w *wallet) setVirtualSelectedParentBlueScore(virtualSelectedParentBlueScore uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.virtualSelectedParentBlueScore = virtualSelectedParentBlueScore
+}
+
+func (w *wallet) setVirtualDAAScore(virtualDAAScore uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.virtualDAAScore = virtualDAAScore
+}
+
+func (w *wallet) currentVirtualSelectedParentBlueScore() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.virtualSelectedParentBlueScore
+}
+
+// spendableUTXOCount returns the number of spendable UTXOs that are
+// not reserved, other than those of excludedAmount. An excludedAmount
+// of zero excludes none.
+func (w *wallet) spendableUTXOCount(excludedAmount uint64) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	count := 0
+	for _, entry := range w.availableUTXOs() {
+		if excludedAmount == 0 || entry.UTXOEntry.Amount != excludedAmount {
+			count++
+		}
+	}
+	return count
+}
+
+// walletBalance is a snapshot of the wallet's funds, in sompi.
+type walletBalance struct {
+	isSynced  bool
+	total     uint64
+	spendable uint64
+	reserved  uint64
+	utxoCount int
+}
+
+// balance returns a snapshot of the wallet's funds. The spendable
+// balance excludes the UTXOs that are reserved by in-flight
+// transactions, and the ones that are not mature yet.
+func (w *wallet) balance() *walletBalance {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	balance := &walletBalance{
+		isSynced:  w.isSynced,
+		spendable: totalAmount(w.availableUTXOs()),
+		utxoCount: len(w.utxos),
+	}
+	for outpoint, entry := range w.utxos {
+		balance.total += entry.UTXOEntry.Amount
+		if _, ok := w.reservedOutpoints[outpoint]; ok {
+			balance.reserved += entry.UTXOEntry.Amount
+		}
+	}
+	return balance
+}
+
+// utxoCountWithAmount returns the number of UTXOs of exactly the given
+// amount that are not reserved, including ones that aren't spendable yet.
+func (w *wallet) utxoCountWithAmount(amount uint64) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	count := 0
+	for outpoint, entry := range w.utxos {
+		if _, ok := w.reservedOutpoints[outpoint]; ok {
+			continue
+		}
+		if entry.UTXOEntry.Amount == amount {
+			count++
+		}
+	}
+	return count
+}
+
+// buildTransaction calls build with the spendable UTXOs that are not
+// reserved, and reserves the inputs of the transaction it returns. The
+// wallet is locked while build runs, so concurrent calls never select
+// the same UTXOs. build may return a nil transaction if there's nothing
+// to build, in which case buildTransaction returns nil as well.
+func (w *wallet) buildTransaction(
+	build func(availableUTXOs []*appmessage.UTXOsByAddressesEntry) (*externalapi.DomainTransaction, error)) (
+	*externalapi.DomainTransaction, error) {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.isSynced {
+		return nil, httpserverutils.NewHandlerErrorWithCustomClientMessage(http.StatusServiceUnavailable,
+			errors.New("the wallet is not synced yet"),
+			"The faucet is still starting up. Please try again later")
+	}
+
+	domainTransaction, err := build(w.availableUTXOs())
+	if err != nil || domainTransaction == nil {
+		return nil, err
+	}
+	for _, input := range domainTransaction.Inputs {
+		w.reservedOutpoints[inputOutpoint(input)] = struct{}{}
+	}
+	return domainTransaction, nil
+}
+
+// release frees the outpoints reserved by the given transaction. It should
+// be called when the transaction could not be submitted.
+func (w *wallet) release(domainTransaction *externalapi.DomainTransaction) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, input := range domainTransaction.Inputs {
+		delete(w.reservedOutpoints, inputOutpoint(input))
+	}
+}
+
+// availableUTXOs returns the spendable UTXOs that are not reserved,
+// including unconfirmed ones if chaining unconfirmed change is enabled.
+// It must be called with the lock held.
+func (w *wallet) availableUTXOs() []*appmessage.UTXOsByAddressesEntry {
+	availableUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0, len(w.utxos))
+	for outpoint, entry := range w.utxos {
+		if _, ok := w.reservedOutpoints[outpoint]; ok {
+			continue
+		}
+		if !w.isSpendable(entry) {
+			continue
+		}
+		availableUTXOs = append(availableUTXOs, entry)
+	}
+	return append(availableUTXOs, w.availableUnconfirmedUTXOs()...)
+}
+
+// isSpendable returns whether the given UTXO is mature enough to be spent
+// according to the spend policy. It must be called with the lock held.
+func (w *wallet) isSpendable(entry *appmessage.UTXOsByAddressesEntry) bool {
+	return utxoSpendPolicy.isUTXOSpendable(entry, w.virtualDAAScore, w.virtualSelectedParentBlueScore)
+}
+
+// reserveOutpoints reserves the given outpoints, so that they aren't
+// selected by buildTransaction.
+func (w *wallet) reserveOutpoints(outpoints []appmessage.RPCOutpoint) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, outpoint := range outpoints {
+		w.reservedOutpoints[outpoint] = struct{}{}
+	}
+}
+
+// releaseOutpoints frees the given reserved outpoints.
+func (w *wallet) releaseOutpoints(outpoints []appmessage.RPCOutpoint) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, outpoint := range outpoints {
+		delete(w.reservedOutpoints, outpoint)
+	}
+}
+
+// isAnyOutpointSpent returns whether any of the given outpoints is
+// missing from the wallet's UTXO set. Unconfirmed outputs of the faucet
+// are only considered spent once their transaction is accepted. It
+// always returns false while the wallet isn't synced.
+func (w *wallet) isAnyOutpointSpent(outpoints []appmessage.RPCOutpoint) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.isSynced {
+		return false
+	}
+	for _, outpoint := range outpoints {
+		if _, ok := w.utxos[outpoint]; ok {
+			continue
+		}
+		utxo, ok := w.unconfirmedUTXOs[outpoint]
+		if !ok || w.unconfirmedTransactions[utxo.transactionID].isAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnyOutpointMissing returns whether any of the given outpoints is
+// missing from the given UTXO set, which was just fetched from the node.
+// Unconfirmed outputs of the faucet whose transaction wasn't accepted
+// yet aren't in the node's UTXO set either, so they aren't missing.
+func (w *wallet) isAnyOutpointMissing(outpoints []appmessage.RPCOutpoint,
+	utxos map[appmessage.RPCOutpoint]struct{}) bool {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, outpoint := range outpoints {
+		if _, ok := utxos[outpoint]; ok {
+			continue
+		}
+		utxo, ok := w.unconfirmedUTXOs[outpoint]
+		if !ok || w.unconfirmedTransactions[utxo.transactionID].isAccepted {
+			return true
+		}
+	}
+	return false
+}
+
+// utxoAddresses returns the addresses of all the UTXOs in the wallet,
+// including unconfirmed ones.
+func (w *wallet) utxoAddresses() map[string]struct{} {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	addresses := make(map[string]struct{})
+	for _, entry := range w.utxos {
+		addresses[entry.Address] = struct{}{}
+	}
+	for _, utxo := range w.unconfirmedUTXOs {
+		addresses[utxo.entry.Address] = struct{}{}
+	}
+	return addresses
+}
+
+func (w *wallet) synced() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.isSynced
+}
+
+func inputOutpoint(input *externalapi.DomainTransactionInput) appmessage.RPCOutpoint {
+	return appmessage.RPCOutpoint{
+		TransactionID: input.PreviousOutpoint.TransactionID.String(),
+		Index:         input.PreviousOutpoint.Index,
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/hex"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/domain/consensus/model/externalapi"
+)
+
+// maxUnconfirmedChainLength is the maximum number of unaccepted
+// transactions in a chain of transactions spending each other's outputs.
+const maxUnconfirmedChainLength = 20
+
+// unconfirmedTransaction is a faucet transaction that isn't confirmed yet,
+// whose outputs to the faucet may be spent by other faucet transactions
+// when chaining unconfirmed change is enabled. The unconfirmed transactions
+// form a graph: a transaction's parents are the unconfirmed transactions
+// whose outputs it spends, and its children are the ones that spend its
+// outputs.
+type unconfirmedTransaction struct {
+	id       string
+	inputs   []appmessage.RPCOutpoint
+	outputs  []appmessage.RPCOutpoint
+	parents  map[string]*unconfirmedTransaction
+	children map[string]*unconfirmedTransaction
+
+	// chainLength is the number of unaccepted transactions in the longest
+	// chain that ends with this transaction, including itself.
+	chainLength int
+	isAccepted  bool
+}
+
+// unconfirmedUTXO is an output that an unconfirmed faucet transaction
+// pays to the faucet.
+type unconfirmedUTXO struct {
+	entry         *appmessage.UTXOsByAddressesEntry
+	transactionID string
+}
+
+// addUnconfirmedTransaction adds the outputs that the given submitted
+// transaction pays to the faucet's addresses to the wallet, so that they can be spent
+// before the transaction is confirmed. It does nothing unless chaining
+// unconfirmed change is enabled.
+func (w *wallet) addUnconfirmedTransaction(transactionID string,
+	domainTransaction *externalapi.DomainTransaction) {
+
+	if !w.chainUnconfirmedChange {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	transaction := &unconfirmedTransaction{
+		id:          transactionID,
+		inputs:      make([]appmessage.RPCOutpoint, len(domainTransaction.Inputs)),
+		parents:     make(map[string]*unconfirmedTransaction),
+		children:    make(map[string]*unconfirmedTransaction),
+		chainLength: 1,
+	}
+	for i, input := range domainTransaction.Inputs {
+		transaction.inputs[i] = inputOutpoint(input)
+		utxo, ok := w.unconfirmedUTXOs[transaction.inputs[i]]
+		if !ok {
+			continue
+		}
+		parent := w.unconfirmedTransactions[utxo.transactionID]
+		transaction.parents[parent.id] = parent
+		parent.children[transactionID] = transaction
+		if !parent.isAccepted && parent.chainLength+1 > transaction.chainLength {
+			transaction.chainLength = parent.chainLength + 1
+		}
+	}
+
+	for i, output := range domainTransaction.Outputs {
+		address, ok := faucetKeys.ownAddress(output.ScriptPublicKey)
+		if !ok {
+			continue
+		}
+		outpoint := appmessage.RPCOutpoint{TransactionID: transactionID, Index: uint32(i)}
+		transaction.outputs = append(transaction.outputs, outpoint)
+		w.unconfirmedUTXOs[outpoint] = &unconfirmedUTXO{
+			entry: &appmessage.UTXOsByAddressesEntry{
+				Address:  address,
+				Outpoint: &outpoint,
+				UTXOEntry: &appmessage.RPCUTXOEntry{
+					Amount: output.Value,
+					ScriptPublicKey: &appmessage.RPCScriptPublicKey{
+						Script:  hex.EncodeToString(output.ScriptPublicKey.Script),
+						Version: output.ScriptPublicKey.Version,
+					},
+					BlockDAAScore: w.virtualDAAScore,
+				},
+			},
+			transactionID: transactionID,
+		}
+	}
+	w.unconfirmedTransactions[transactionID] = transaction
+}
+
+// setUnconfirmedTransactionAccepted marks the given transaction as
+// accepted, so that it no longer counts towards the length of the
+// chains it's part of.
+func (w *wallet) setUnconfirmedTransactionAccepted(transactionID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	transaction, ok := w.unconfirmedTransactions[transactionID]
+	if !ok {
+		return
+	}
+	transaction.isAccepted = true
+}
+
+// removeUnconfirmedTransaction removes the given confirmed transaction
+// from the graph. From now on, its outputs are spent only through
+// the wallet's UTXO set.
+func (w *wallet) removeUnconfirmedTransaction(transactionID string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	transaction, ok := w.unconfirmedTransactions[transactionID]
+	if !ok {
+		return
+	}
+	w.removeFromGraph(transaction)
+}
+
+// invalidateUnconfirmedTransaction removes the given rejected transaction
+// and all its descendants from the graph, since none of them can be
+// accepted anymore, and releases the inputs of the descendants. It
+// returns the IDs of the invalidated descendants.
+func (w *wallet) invalidateUnconfirmedTransaction(transactionID string) []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	transaction, ok := w.unconfirmedTransactions[transactionID]
+	if !ok {
+		return nil
+	}
+
+	var descendantIDs []string
+	queue := []*unconfirmedTransaction{transaction}
+	visited := map[string]struct{}{transactionID: {}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for childID, child := range current.children {
+			if _, ok := visited[childID]; ok {
+				continue
+			}
+			visited[childID] = struct{}{}
+			descendantIDs = append(descendantIDs, childID)
+			queue = append(queue, child)
+		}
+		w.removeFromGraph(current)
+		if current != transaction {
+			for _, input := range current.inputs {
+				delete(w.reservedOutpoints, input)
+			}
+		}
+	}
+	return descendantIDs
+}
+
+// removeFromGraph must be called with the lock held.
+func (w *wallet) removeFromGraph(transaction *unconfirmedTransaction) {
+	for _, outpoint := range transaction.outputs {
+		delete(w.unconfirmedUTXOs, outpoint)
+	}
+	for _, parent := range transaction.parents {
+		delete(parent.children, transaction.id)
+	}
+	for _, child := range transaction.children {
+		delete(child.parents, transaction.id)
+	}
+	delete(w.unconfirmedTransactions, transaction.id)
+}
+
+// availableUnconfirmedUTXOs returns the unconfirmed outputs of the faucet
+// that are not reserved, not already spendable through the wallet's UTXO
+// set, and whose chains are not too long to extend.
+// It must be called with the lock held.
+func (w *wallet) availableUnconfirmedUTXOs() []*appmessage.UTXOsByAddressesEntry {
+	if !w.chainUnconfirmedChange {
+		return nil
+	}
+	availableUTXOs := make([]*appmessage.UTXOsByAddressesEntry, 0, len(w.unconfirmedUTXOs))
+	for outpoint, utxo := range w.unconfirmedUTXOs {
+		if _, ok := w.reservedOutpoints[outpoint]; ok {
+			continue
+		}
+		if entry, ok := w.utxos[outpoint]; ok && w.isSpendable(entry) {
+			continue
+		}
+		transaction := w.unconfirmedTransactions[utxo.transactionID]
+		if !transaction.isAccepted && transaction.chainLength >= maxUnconfirmedChainLength {
+			continue
+		}
+		availableUTXOs = append(availableUTXOs, utxo.entry)
+	}
+	return availableUTXOs
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kaspanet/kaspad/app/appmessage"
+	"github.com/kaspanet/kaspad/infrastructure/network/rpcclient"
+)
+
+// walletResyncInterval is the interval between full resyncs of the
+// wallet, which catch any drift between the UTXO index and kaspad.
+const walletResyncInterval = 5 * time.Minute
+
+// syncWallet subscribes to the notifications that keep the wallet up to
+// date, and then resyncs it. It's called every time the RPC client connects.
+func syncWallet(client *rpcclient.RPCClient) {
+	err := registerForUTXOsChangedNotifications(client)
+	if err != nil {
+		log.Errorf("Error registering for UTXOs changed notifications: %s", err)
+	}
+
+	err = client.RegisterForVirtualSelectedParentBlueScoreChangedNotifications(
+		func(notification *appmessage.VirtualSelectedParentBlueScoreChangedNotificationMessage) {
+			faucetWallet.setVirtualSelectedParentBlueScore(notification.VirtualSelectedParentBlueScore)
+			submittedTransactions.handleVirtualSelectedParentBlueScoreChanged(
+				notification.VirtualSelectedParentBlueScore)
+		})
+	if err != nil {
+		log.Errorf("Error registering for virtual selected parent blue score changed notifications: %s", err)
+	}
+
+	err = client.RegisterForVirtualDaaScoreChangedNotifications(
+		func(notification *appmessage.VirtualDaaScoreChangedNotificationMessage) {
+			faucetWallet.setVirtualDAAScore(notification.VirtualDaaScore)
+		})
+	if err != nil {
+		log.Errorf("Error registering for virtual DAA score changed notifications: %s", err)
+	}
+
+	err = resyncWallet(client)
+	if err != nil {
+		log.Errorf("Error resyncing the wallet: %s", err)
+	}
+}
+
+// registerForUTXOsChangedNotifications subscribes to the UTXO changes of
+// all the faucet's addresses. kaspad's RPC client starts another
+// notification consumer every time it's called, and concurrent consumers
+// may apply notifications out of order, so it must be called only once
+// per client.
+func registerForUTXOsChangedNotifications(client *rpcclient.RPCClient) error {
+	return client.RegisterForUTXOsChangedNotifications(faucetKeys.watchedAddresses(),
+		func(notification *appmessage.UTXOsChangedNotificationMessage) {
+			// Once a client is renewed, its notifications are covered
+			// by the resync that follows the renewal instead
+			if faucetRPCConnection != nil && !faucetRPCConnection.isCurrentClient(client) {
+				return
+			}
+			faucetWallet.applyUTXOsChanged(notification.Added, notification.Removed)
+			submittedTransactions.handleSpentUTXOs(notification.Removed,
+				faucetWallet.currentVirtualSelectedParentBlueScore())
+		})
+}
+
+// handleWatchedAddressesAdded subscribes to the UTXO changes of newly
+// watched addresses by renewing the RPC client, since the subscription
+// of a client can't be extended without starting another consumer. The
+// new client subscribes to all the watched addresses. If the RPC client
+// isn't connected, they're subscribed to once it reconnects.
+func handleWatchedAddressesAdded() {
+	if faucetRPCConnection == nil {
+		return
+	}
+	err := faucetRPCConnection.renew()
+	if err != nil {
+		log.Errorf("Error renewing the RPC client to watch new addresses: %s", err)
+	}
+}
+
+func resyncWallet(client *rpcclient.RPCClient) error {
+	utxos, virtualSelectedParentBlueScore, virtualDAAScore, err := fetchUTXOs(client)
+	if err != nil {
+		return err
+	}
+	faucetWallet.resync(utxos, virtualSelectedParentBlueScore, virtualDAAScore)
+	log.Debugf("Resynced the wallet with %d UTXOs", len(utxos))
+
+	err = retireChangeAddresses()
+	if err != nil {
+		log.Errorf("Error retiring change addresses: %s", err)
+	}
+	return nil
+}
+
+// retireChangeAddresses stops watching the used change addresses that
+// hold none of the faucet's UTXOs, and that no pending transaction pays.
+// Until the pending transactions that were loaded from the database are
+// done, it's unknown which addresses they pay, so none are retired.
+func retireChangeAddresses() error {
+	// The pending transactions are collected before the UTXOs, since a
+	// transaction that stops being pending has its outputs in the
+	// wallet's UTXO set by then.
+	addressesInUse, ok := submittedTransactions.pendingOwnAddresses()
+	if !ok {
+		return nil
+	}
+	for address := range faucetWallet.utxoAddresses() {
+		addressesInUse[address] = struct{}{}
+	}
+	return faucetKeys.retireChangeAddresses(addressesInUse)
+}
+
+// walletResyncLoop periodically resyncs the wallet while the RPC
+// client is connected.
+func walletResyncLoop() {
+	for range time.Tick(walletResyncInterval) {
+		client, err := faucetRPCConnection.connectedClient()
+		if err != nil {
+			continue
+		}
+		err = resyncWallet(client)
+		if err != nil {
+			log.Errorf("Error resyncing the wallet: %s", err)
+		}
+	}
+}